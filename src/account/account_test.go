@@ -0,0 +1,455 @@
+package account
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	"github.com/futurehomeno/fimpgo/discovery"
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/model"
+)
+
+func TestRouterAndPollerShareAccount(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	// Poller fetches the account and reads the local heater while the router handles messages
+	var polls sync.WaitGroup
+	polls.Add(1)
+	go func() {
+		defer polls.Done()
+		for i := 0; i < 5; i++ {
+			ta.lock.Lock()
+			ta.schedule.fetchedAt = time.Time{}
+			ta.lock.Unlock()
+			if !ta.poll(ta.mqt, ta.schedule, ta.reports) {
+				t.Error("poller was stopped")
+				return
+			}
+		}
+	}()
+
+	var requests, setpointD1, setpointD2, syncs []*fimpgo.FimpMessage
+	for i := 0; i < 3; i++ {
+		setpointD1 = append(setpointD1, ta.send(t, "d1", "thermostat", "cmd.setpoint.get_report", fimpgo.VTypeNull, nil))
+		setpointD2 = append(setpointD2, ta.send(t, "d2", "thermostat", "cmd.setpoint.get_report", fimpgo.VTypeNull, nil))
+		syncs = append(syncs, ta.sendAdapter(t, "cmd.system.sync"))
+		requests = append(requests,
+			ta.send(t, "d1", "sensor_temp", "cmd.sensor.get_report", fimpgo.VTypeNull, nil),
+			ta.send(t, "d2", "thermostat", "cmd.mode.get_report", fimpgo.VTypeNull, nil),
+			ta.send(t, "d3", "out_bin_switch", "cmd.binary.get_report", fimpgo.VTypeNull, nil),
+		)
+	}
+	requests = append(append(append(requests, setpointD1...), setpointD2...), syncs...)
+	replies := ta.waitReplies(t, requests, func(reply *fimpgo.FimpMessage) bool {
+		// Sync announces devices in response to the request before it answers
+		return reply.Type != "evt.thing.inclusion_report"
+	})
+	polls.Wait()
+
+	for _, req := range setpointD1 {
+		if val, _ := replies[req.UID].GetStrMapValue(); val["temp"] != "22" {
+			t.Errorf("cloud heater reported setpoint %s, expected 22", val["temp"])
+		}
+	}
+	for _, req := range setpointD2 {
+		if val, _ := replies[req.UID].GetStrMapValue(); val["temp"] != "19.5" {
+			t.Errorf("local heater reported setpoint %s, expected 19.5 from local api", val["temp"])
+		}
+	}
+	for _, req := range syncs {
+		result := map[string]interface{}{}
+		if err := replies[req.UID].GetObjectValue(&result); err != nil || result["success"] != true {
+			t.Errorf("sync failed: %v", result["errors"])
+		}
+	}
+}
+
+func TestCommandIsConfirmedWhilePolling(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ta.poll(ta.mqt, ta.schedule, ta.reports)
+	}()
+	req := ta.send(t, "d1", "thermostat", "cmd.setpoint.set", fimpgo.VTypeStrMap, map[string]string{"type": "heat", "temp": "22"})
+	ta.waitReplies(t, []*fimpgo.FimpMessage{req}, func(reply *fimpgo.FimpMessage) bool {
+		return reply.Type == "evt.setpoint.report" && reply.Properties["state"] == "confirmed"
+	})
+	<-done
+}
+
+func TestRouterReleasesLockDuringHeaterCall(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	release := ta.heater.Hold("GET /operation-mode")
+	defer release()
+	req := ta.send(t, "d2", "thermostat", "cmd.mode.get_report", fimpgo.VTypeNull, nil)
+	ta.heater.WaitArrived(t, "GET /operation-mode")
+	ta.assertUnlocked(t, "the router waits for the heater")
+	release()
+	ta.waitReplies(t, []*fimpgo.FimpMessage{req}, func(reply *fimpgo.FimpMessage) bool {
+		return reply.Type == "evt.mode.report"
+	})
+}
+
+func TestRouterReleasesLockDuringCloudCall(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	release := ta.mill.Hold("GET /houses")
+	defer release()
+	req := ta.sendAdapter(t, "cmd.system.sync")
+	ta.mill.WaitArrived(t, "GET /houses")
+	ta.assertUnlocked(t, "the router waits for Mill")
+	release()
+	ta.waitReplies(t, []*fimpgo.FimpMessage{req}, func(reply *fimpgo.FimpMessage) bool { return true })
+}
+
+func TestPollerReleasesLockDuringFetch(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	release := ta.mill.Hold("GET /houses")
+	defer release()
+	done := make(chan bool)
+	go func() {
+		done <- ta.poll(ta.mqt, ta.schedule, ta.reports)
+	}()
+	ta.mill.WaitArrived(t, "GET /houses")
+	ta.assertUnlocked(t, "the poller waits for Mill")
+	release()
+	if !<-done {
+		t.Fatal("poller was stopped")
+	}
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	if len(ta.States.DeviceCollection) != 3 {
+		t.Errorf("fetched %d devices, expected 3", len(ta.States.DeviceCollection))
+	}
+}
+
+func TestPollerKeepsTokensChangedDuringRefresh(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	ta.lock.Lock()
+	ta.Configs.Auth.ExpireTime = 1
+	ta.lock.Unlock()
+	release := ta.mill.Hold("POST /customer/auth/refresh")
+	defer release()
+	done := make(chan bool)
+	go func() {
+		done <- ta.refreshTokens()
+	}()
+	ta.mill.WaitArrived(t, "POST /customer/auth/refresh")
+	// User logs in again while the poller waits for Mill
+	ta.lock.Lock()
+	ta.Configs.Auth.AccessToken, ta.Configs.Auth.RefreshToken = "login", "login-refresh"
+	ta.lock.Unlock()
+	release()
+	if !<-done {
+		t.Fatal("poller was stopped")
+	}
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	if ta.Configs.Auth.AccessToken != "login" || ta.Configs.Auth.RefreshToken != "login-refresh" {
+		t.Errorf("tokens of the new login were replaced by %s, %s", ta.Configs.Auth.AccessToken, ta.Configs.Auth.RefreshToken)
+	}
+}
+
+func TestEveryAccountIsAdvertised(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	reports := make(fimpgo.MessageCh, 10)
+	ta.mqt.RegisterChannelWithFilterFunc("discovery-reports", reports, func(topic string, addr *fimpgo.Address, msg *fimpgo.FimpMessage) bool {
+		return msg.Type == "evt.discovery.report"
+	})
+	ta.manager.mux.Lock()
+	ta.manager.accounts["2"] = &Account{Instance: "2"}
+	ta.manager.mux.Unlock()
+
+	req := fimpgo.NewNullMessage("cmd.discovery.request", "system", nil, nil, nil)
+	if err := ta.mqt.Publish(&fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeDiscovery}, req); err != nil {
+		t.Fatal(err)
+	}
+	var instances []string
+	timeout := time.After(waitTimeout)
+	for len(instances) < 2 {
+		select {
+		case msg := <-reports:
+			resource := discovery.Resource{}
+			if err := msg.Payload.GetObjectValue(&resource); err != nil {
+				t.Fatal(err)
+			}
+			instances = append(instances, resource.InstanceId)
+		case <-timeout:
+			t.Fatalf("advertised instances %v, expected 1 and 2", instances)
+		}
+	}
+	sort.Strings(instances)
+	if instances[0] != "1" || instances[1] != "2" {
+		t.Errorf("advertised instances %v, expected 1 and 2", instances)
+	}
+}
+
+func TestHubTokenIsTakenByRequestingInstance(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	ta.lock.Lock()
+	ta.Configs.ApiBackend = mill.BackendLegacy
+	ta.lock.Unlock()
+	tokenRequests := make(fimpgo.MessageCh, 10)
+	ta.mqt.RegisterChannelWithFilterFunc("hub-token", tokenRequests, func(topic string, addr *fimpgo.Address, msg *fimpgo.FimpMessage) bool {
+		return msg.Type == "cmd.hub_auth.get_jwt"
+	})
+	login := fimpgo.NewObjectMessage("cmd.auth.login", model.ServiceName, map[string]string{"username": "user", "password": "secret"}, nil, nil, nil)
+	if err := ta.mqt.Publish(&fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: ta.Instance}, login); err != nil {
+		t.Fatal(err)
+	}
+	var tokenRequest *fimpgo.Message
+	select {
+	case tokenRequest = <-tokenRequests:
+	case <-time.After(waitTimeout):
+		t.Fatal("hub token was not requested")
+	}
+
+	authAddr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeCloud, ResourceName: "auth-api", ResourceAddress: "1"}
+	// Reply to a login on another instance comes first
+	other := fimpgo.NewStrMapMessage("evt.hub_auth.jwt_report", "auth-api", map[string]string{"token": "other"}, nil, nil, nil)
+	other.CorrelationID = "other-login"
+	own := fimpgo.NewStrMapMessage("evt.hub_auth.jwt_report", "auth-api", map[string]string{"token": "own"}, nil, nil, tokenRequest.Payload)
+	for _, msg := range []*fimpgo.FimpMessage{other, own} {
+		if err := ta.mqt.Publish(authAddr, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replies are routed in order, so a login continued with the other reply is seen first
+	timeout := time.After(waitTimeout)
+	for {
+		select {
+		case msg := <-ta.replies:
+			if msg.Payload.Type != "cmd.auth.set_tokens" {
+				continue
+			}
+			if msg.Payload.CorrelationID == other.UID {
+				t.Fatal("instance took the hub token requested by another instance")
+			}
+			if msg.Payload.CorrelationID == own.UID {
+				return
+			}
+		case <-timeout:
+			t.Fatal("login was not continued with the requested hub token")
+		}
+	}
+}
+
+func TestCommandToInvalidAddressIsAnswered(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	for name, address := range map[string]string{
+		"too many parts":   "1_h1_d1_extra",
+		"another instance": "2_h1_d1",
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := fimpgo.NewNullMessage("cmd.setpoint.get_report", "thermostat", nil, nil, nil)
+			addr := &fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: ta.Instance, ServiceName: "thermostat", ServiceAddress: address}
+			if err := ta.mqt.Publish(addr, req); err != nil {
+				t.Fatal(err)
+			}
+			replies := ta.waitReplies(t, []*fimpgo.FimpMessage{req}, func(reply *fimpgo.FimpMessage) bool {
+				return reply.Type == "evt.error.report"
+			})
+			report := model.ErrorReport{}
+			if err := replies[req.UID].GetObjectValue(&report); err != nil || report.ErrorCode != model.ErrCodeWrongFormat {
+				t.Errorf("got error report %+v, expected %s", report, model.ErrCodeWrongFormat)
+			}
+		})
+	}
+}
+
+func TestPollerReadsHeatingDevicesOfAHomeTogether(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	if !ta.poll(ta.mqt, ta.schedule, ta.reports) {
+		t.Fatal("poller was stopped")
+	}
+	// Both heaters in the room heat, and are read between fetches
+	ta.lock.Lock()
+	ta.States.SetLocalAddress("d2", "")
+	for _, deviceID := range []string{"d1", "d2"} {
+		ta.schedule.devices[deviceID].heating = true
+		ta.schedule.devices[deviceID].at = time.Now().Add(-time.Hour)
+	}
+	ta.lock.Unlock()
+	fetches := ta.mill.Count("GET /houses")
+	if !ta.poll(ta.mqt, ta.schedule, ta.reports) {
+		t.Fatal("poller was stopped")
+	}
+	if got := ta.mill.Count("GET /houses"); got != fetches {
+		t.Fatalf("account was fetched again")
+	}
+	if got := ta.mill.Count("GET /houses/h1/devices"); got != 2 {
+		t.Errorf("house devices were fetched %d times, expected once by the fetch and once for both heaters", got)
+	}
+}
+
+func TestCloudHeaterIsTurnedOff(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	if !ta.poll(ta.mqt, ta.schedule, ta.reports) {
+		t.Fatal("poller was stopped")
+	}
+	req := ta.send(t, "d1", "thermostat", "cmd.mode.set", fimpgo.VTypeString, "off")
+	replies := ta.waitReplies(t, []*fimpgo.FimpMessage{req}, func(reply *fimpgo.FimpMessage) bool {
+		return reply.Type == "evt.mode.report" || reply.Type == "evt.error.report"
+	})
+	if mode, _ := replies[req.UID].GetStringValue(); replies[req.UID].Type != "evt.mode.report" || mode != "off" {
+		t.Errorf("got %s %s, expected mode off", replies[req.UID].Type, mode)
+	}
+	if got := ta.mill.Count("PATCH /devices/d1/settings"); got != 1 {
+		t.Errorf("heater settings were changed %d times, expected once", got)
+	}
+}
+
+func TestCloudSetpointKeepsDecimals(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	if !ta.poll(ta.mqt, ta.schedule, ta.reports) {
+		t.Fatal("poller was stopped")
+	}
+	req := ta.send(t, "d1", "thermostat", "cmd.setpoint.set", fimpgo.VTypeStrMap, map[string]string{"type": "heat", "temp": "21.5"})
+	replies := ta.waitReplies(t, []*fimpgo.FimpMessage{req}, func(reply *fimpgo.FimpMessage) bool {
+		return reply.Type == "evt.setpoint.report" && reply.Properties["state"] == model.CommandStatePending || reply.Type == "evt.error.report"
+	})
+	if val, _ := replies[req.UID].GetStrMapValue(); val["temp"] != "21.5" {
+		t.Errorf("cloud heater was set to %s, expected 21.5", val["temp"])
+	}
+}
+
+func TestPollerCompletesPollWhenStopped(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	release := ta.mill.Hold("GET /houses")
+	defer release()
+	done := make(chan bool)
+	go func() {
+		done <- ta.poll(ta.mqt, ta.schedule, ta.reports)
+	}()
+	ta.mill.WaitArrived(t, "GET /houses")
+	// Adapter shuts down while the poller waits for Mill
+	ta.cancel()
+	release()
+	if !<-done {
+		t.Fatal("poll was aborted")
+	}
+	if ta.waitForPoll(ta.schedule) {
+		t.Error("poller continues after the account was stopped")
+	}
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	if len(ta.States.DeviceCollection) != 3 {
+		t.Errorf("got %d devices, expected the fetch to complete", len(ta.States.DeviceCollection))
+	}
+}
+
+func TestStopWaitsForRemovedAccount(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+	manager, mqt, workDir := ta.startManager(t, "2")
+	defer os.RemoveAll(workDir)
+
+	// Account 2 is removed while its router waits for Mill
+	release := ta.mill.Hold("GET /houses")
+	defer release()
+	msg := fimpgo.NewNullMessage("cmd.system.sync", model.ServiceName, nil, nil, nil)
+	addr := &fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "2"}
+	if err := ta.mqt.Publish(addr, msg); err != nil {
+		t.Fatal(err)
+	}
+	ta.mill.WaitArrived(t, "GET /houses")
+	// Transport is stopped before the router, like in newTestAccount
+	mqt.Stop()
+	if err := manager.RemoveAccount("2"); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		manager.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("manager stopped while account 2 was being removed")
+	case <-time.After(200 * time.Millisecond):
+	}
+	release()
+	<-stopped
+	if instances := model.AccountInstances(workDir); len(instances) != 0 {
+		t.Errorf("files of account instances %v are left after stop", instances)
+	}
+}
+
+func TestEveryAccountTerminates(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+	manager, mqt, workDir := ta.startManager(t, "2", "3")
+	defer os.RemoveAll(workDir)
+
+	lifecycles := []*model.Lifecycle{}
+	for _, instance := range manager.Accounts() {
+		lifecycles = append(lifecycles, manager.accounts[instance].Lifecycle)
+	}
+	mqt.Stop()
+	manager.Stop()
+	for i, lifecycle := range lifecycles {
+		if state := lifecycle.AppState(); state != model.AppStateTerminate {
+			t.Errorf("account %d is in app state %s after stop", i+2, state)
+		}
+	}
+}
+
+func TestReincludeOfUnknownDeviceKeepsExclusions(t *testing.T) {
+	ta := newTestAccount(t)
+	defer ta.close()
+
+	if !ta.poll(ta.mqt, ta.schedule, ta.reports) {
+		t.Fatal("poller was stopped")
+	}
+	// Device deleted by the user was later removed from the Mill account
+	ta.lock.Lock()
+	ta.States.Exclude("gone")
+	ta.lock.Unlock()
+	req := fimpgo.NewStringMessage("cmd.thing.reinclude", model.ServiceName, "gone", nil, nil, nil)
+	req.ResponseToTopic = "pt:j1/mt:rsp/rt:app/rn:mill-test/ad:1"
+	addr := &fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: ta.Instance}
+	if err := ta.mqt.Publish(addr, req); err != nil {
+		t.Fatal(err)
+	}
+	replies := ta.waitReplies(t, []*fimpgo.FimpMessage{req}, func(reply *fimpgo.FimpMessage) bool {
+		return reply.Type == "evt.error.report"
+	})
+	report := model.ErrorReport{}
+	if err := replies[req.UID].GetObjectValue(&report); err != nil || report.ErrorCode != model.ErrCodeDeviceNotFound {
+		t.Errorf("got error report %+v, expected %s", report, model.ErrCodeDeviceNotFound)
+	}
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	if !ta.States.IsExcluded("gone") {
+		t.Error("unknown device was removed from the exclusion list")
+	}
+}
@@ -0,0 +1,125 @@
+package account
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/model"
+)
+
+const (
+	// outageProbeInterval is how often Mill is probed while it can't be used
+	outageProbeInterval = time.Minute
+	// idleProbeInterval is how long Mill may go without calls before it is probed
+	idleProbeInterval = 5 * time.Minute
+	// internetCheckMaxAge is how long the result of an internet check is reused
+	internetCheckMaxAge = 30 * time.Second
+)
+
+// connectivityMonitor derives whether Mill can be used from the outcome of calls to Mill made by router and poller.
+// When a call fails, an internet check tells whether the hub or Mill is down. While Mill can't be used, or when it
+// hasn't been called for a while, it is probed with a cheap call.
+type connectivityMonitor struct {
+	mux       sync.Mutex
+	lifecycle *model.Lifecycle
+	// lastCall is when the outcome of a call to Mill was last recorded
+	lastCall     time.Time
+	connectivity string
+	// internetUp is the result of the last internet check, made at internetCheckedAt
+	internetUp          bool
+	internetCheckedAt   time.Time
+	isInternetAvailable func() bool
+}
+
+func newConnectivityMonitor(lifecycle *model.Lifecycle) *connectivityMonitor {
+	return &connectivityMonitor{lifecycle: lifecycle, isInternetAvailable: edgeapp.NewSystemCheck().IsInternetAvailable}
+}
+
+// record updates connectivity from the outcome of a call to Mill that needs the access token. Returns true if Mill
+// can be used again after an outage.
+func (cm *connectivityMonitor) record(err error) bool {
+	connectivity := cm.classify(err)
+	cm.mux.Lock()
+	recovered := connectivity == model.ConnectivityOK && cm.connectivity != model.ConnectivityOK && cm.connectivity != model.ConnectivityUnknown
+	if connectivity != cm.connectivity {
+		log.Info("<account> Mill connectivity changed from ", cm.connectivity, " to ", connectivity)
+	}
+	cm.connectivity = connectivity
+	cm.lastCall = time.Now()
+	cm.mux.Unlock()
+	cm.lifecycle.SetConnectivity(connectivity, err)
+	return recovered
+}
+
+// classify tells why a call to Mill failed
+func (cm *connectivityMonitor) classify(err error) string {
+	switch {
+	case err == nil:
+		return model.ConnectivityOK
+	case errors.Is(err, mill.ErrUnauthorized):
+		return model.ConnectivityTokenRejected
+	case !cm.internetAvailable():
+		return model.ConnectivityNoInternet
+	}
+	return model.ConnectivityMillDown
+}
+
+// internetAvailable checks the internet connection of the hub, reusing a recent result
+func (cm *connectivityMonitor) internetAvailable() bool {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	if time.Since(cm.internetCheckedAt) > internetCheckMaxAge {
+		cm.internetUp = cm.isInternetAvailable()
+		cm.internetCheckedAt = time.Now()
+	}
+	return cm.internetUp
+}
+
+// probeDue tells if Mill should be probed, because it can't be used or hasn't been called for a while
+func (cm *connectivityMonitor) probeDue(now time.Time) bool {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	if cm.connectivity == model.ConnectivityOK {
+		return now.Sub(cm.lastCall) >= idleProbeInterval
+	}
+	return now.Sub(cm.lastCall) >= outageProbeInterval
+}
+
+// runConnectivityMonitor probes Mill until the account is stopped. When Mill can be used again after an outage,
+// the poller is woken, so device lists and reports are refreshed right away.
+func (ac *Account) runConnectivityMonitor() {
+	defer ac.running.Done()
+	ticker := time.NewTicker(outageProbeInterval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ac.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !ac.monitor.probeDue(now) {
+				continue
+			}
+			ac.lock.Lock()
+			backend := mill.NewBackend(ac.Configs.ApiBackend)
+			accessToken := ac.Configs.Auth.AccessToken
+			ac.lock.Unlock()
+			if accessToken == "" {
+				// Nothing to probe before login
+				continue
+			}
+			log.Debug("<account> Probing Mill for account instance ", ac.Instance)
+			err := backend.Ping(ac.callCtx, accessToken)
+			if ac.callCtx.Err() != nil {
+				// Account was stopped during the probe
+				return
+			}
+			if ac.monitor.record(err) {
+				ac.reschedule()
+			}
+		}
+	}
+}
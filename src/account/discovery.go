@@ -0,0 +1,50 @@
+package account
+
+import (
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/mill/model"
+)
+
+const discoveryRequestTopic = "pt:j1/mt:cmd/rt:discovery"
+
+// startDiscovery starts answering discovery requests
+func (mg *Manager) startDiscovery() {
+	requestCh := make(fimpgo.MessageCh, 5)
+	mg.mqt.Subscribe(discoveryRequestTopic)
+	mg.mqt.RegisterChannelWithFilter("discovery-responder", requestCh, fimpgo.FimpFilter{Topic: discoveryRequestTopic, Service: "*", Interface: "*"})
+	mg.running.Add(1)
+	go mg.runDiscovery(requestCh)
+}
+
+// stopDiscovery stops answering discovery requests and waits for the report being sent, and for accounts being removed
+func (mg *Manager) stopDiscovery() {
+	mg.mqt.UnregisterChannel("discovery-responder")
+	close(mg.stopCh)
+	mg.running.Wait()
+}
+
+// runDiscovery answers discovery requests with one report per running account instance, so every instance
+// can be configured from the playground. The fimpgo responder advertises a single resource only.
+func (mg *Manager) runDiscovery(requestCh fimpgo.MessageCh) {
+	defer mg.running.Done()
+	for {
+		select {
+		case <-requestCh:
+			for _, instance := range mg.Accounts() {
+				mg.advertise(instance)
+			}
+		case <-mg.stopCh:
+			return
+		}
+	}
+}
+
+// advertise publishes the discovery report of an account instance
+func (mg *Manager) advertise(instance string) {
+	msg := fimpgo.NewMessage("evt.discovery.report", "system", fimpgo.VTypeObject, model.GetDiscoveryResource(instance), nil, nil, nil)
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDiscovery}
+	if err := mg.mqt.Publish(&adr, msg); err != nil {
+		log.Error("<account> Can't advertise account instance ", instance, ". Error: ", err)
+	}
+}
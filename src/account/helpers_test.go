@@ -0,0 +1,371 @@
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/futurehomeno/fimpgo"
+
+	"github.com/thingsplex/mill/internal/standin"
+	"github.com/thingsplex/mill/model"
+	"github.com/thingsplex/mill/router"
+)
+
+// waitTimeout is how long tests wait for replies
+const waitTimeout = 10 * time.Second
+
+// broker is a minimal MQTT broker. Every publish is forwarded to every client, subscriptions are only
+// acknowledged. fimpgo reads its subscriptions without locking when it connects, so the router and discovery are
+// started before the transport is connected, and their subscriptions fail.
+type broker struct {
+	listener net.Listener
+	mux      sync.Mutex
+	clients  map[net.Conn]*brokerClient
+}
+
+type brokerClient struct {
+	// outCh is written by a goroutine of its own, so a slow client never blocks the broker
+	outCh chan packets.ControlPacket
+}
+
+// startBroker starts a broker on a free local port and returns its uri and listener
+func startBroker(t *testing.T) (string, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{listener: listener, clients: make(map[net.Conn]*brokerClient)}
+	go b.accept()
+	return "tcp://" + listener.Addr().String(), listener
+}
+
+func (b *broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		client := &brokerClient{outCh: make(chan packets.ControlPacket, 1000)}
+		b.mux.Lock()
+		b.clients[conn] = client
+		b.mux.Unlock()
+		go func() {
+			for cp := range client.outCh {
+				if cp.Write(conn) != nil {
+					return
+				}
+			}
+		}()
+		go b.serve(conn, client)
+	}
+}
+
+func (b *broker) serve(conn net.Conn, client *brokerClient) {
+	defer func() {
+		b.mux.Lock()
+		delete(b.clients, conn)
+		close(client.outCh)
+		b.mux.Unlock()
+		conn.Close()
+	}()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		b.mux.Lock()
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			client.outCh <- packets.NewControlPacket(packets.Connack)
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID, ack.ReturnCodes = p.MessageID, make([]byte, len(p.Topics))
+			client.outCh <- ack
+		case *packets.UnsubscribePacket:
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			client.outCh <- ack
+		case *packets.PublishPacket:
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				client.outCh <- ack
+			}
+			for _, other := range b.clients {
+				fwd := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				fwd.TopicName, fwd.Payload = p.TopicName, p.Payload
+				other.outCh <- fwd
+			}
+		case *packets.PingreqPacket:
+			client.outCh <- packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			b.mux.Unlock()
+			return
+		}
+		b.mux.Unlock()
+	}
+}
+
+// redirect sends requests for hosts to a stand-in server
+type redirect struct {
+	hosts  []string
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (rd redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rd.redirects(req.URL.Host) {
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host, req.Host = rd.target.Scheme, rd.target.Host, ""
+	}
+	return rd.next.RoundTrip(req)
+}
+
+func (rd redirect) redirects(host string) bool {
+	for _, h := range rd.hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// millResponses is a customer api account with one house, a heater controlled through the cloud, a heater with
+// local api in the same room and an independent socket
+var millResponses = map[string]string{
+	"POST /customer/auth/sign-in": `{"idToken":"signed-in","refreshToken":"signed-in-refresh"}`,
+	"POST /customer/auth/refresh": `{"idToken":"refreshed","refreshToken":"refreshed-refresh"}`,
+	"GET /houses":                 `{"ownHouses":[{"id":"h1","name":"Home"}]}`,
+	"GET /houses/h1/devices": `[{"roomId":"r1","roomName":"Living room","devices":[
+		{"deviceId":"d1","customName":"Cloud heater","isConnected":true,"deviceType":{"parentType":{"name":"Heaters"},"childType":{"name":"Panel Heater Gen. 3"}},"lastMetrics":{"temperatureAmbient":21.5},"deviceSettings":{"reported":{"temperature_normal":22,"operation_mode":"control_individually"}}},
+		{"deviceId":"d2","customName":"Local heater","isConnected":true,"deviceType":{"parentType":{"name":"Heaters"},"childType":{"name":"Panel Heater Gen. 3"}},"lastMetrics":{"temperatureAmbient":20},"deviceSettings":{"reported":{"temperature_normal":20,"operation_mode":"control_individually"}}}]}]`,
+	"GET /houses/h1/devices/independent": `{"items":[{"deviceId":"d3","customName":"Socket","isConnected":true,"deviceType":{"parentType":{"name":"Sockets"},"childType":{"name":"WiFi Socket Gen. 3"}},"deviceSettings":{"reported":{"operation_mode":"control_individually"}}}]}`,
+	"PATCH /devices/d1/settings":         `{}`,
+	"PATCH /devices/d3/settings":         `{}`,
+}
+
+// heaterResponses is the local api of heater d2
+var heaterResponses = map[string]string{
+	"GET /status":           `{"name":"Mill","version":"1","status":"ok"}`,
+	"GET /control-status":   `{"ambient_temperature":19.25,"set_temperature":19.5,"status":"ok"}`,
+	"POST /set-temperature": `{"status":"ok"}`,
+	"GET /operation-mode":   `{"mode":"Control individually","status":"ok"}`,
+	"POST /operation-mode":  `{"status":"ok"}`,
+}
+
+// testAccount is an account logged in to a Mill stand-in, with its router started on a local broker. The poller is
+// not started, tests run polls with poll.
+type testAccount struct {
+	*Account
+	manager *Manager
+	mqt     *fimpgo.MqttTransport
+	// brokerURI is the local broker, for tests that connect another transport
+	brokerURI string
+	mill      *standin.Server
+	heater    *standin.Server
+	schedule  *pollSchedule
+	reports   *reportFilter
+	// replies receives messages sent in response to a request
+	replies fimpgo.MessageCh
+	// cleanup is run in reverse order by close
+	cleanup []func()
+}
+
+func newTestAccount(t *testing.T) *testAccount {
+	workDir, err := ioutil.TempDir("", "mill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta := &testAccount{mill: standin.New(standin.Responses(millResponses)), heater: standin.New(standin.Responses(heaterResponses)), replies: make(fimpgo.MessageCh, 100)}
+	ta.cleanup = append(ta.cleanup, func() { os.RemoveAll(workDir) }, ta.mill.Close, ta.heater.Close)
+	farFuture := time.Now().Add(24*time.Hour).UnixNano() / 1000000
+	config := map[string]interface{}{
+		"poll_time_min": "5",
+		"api_backend":   "customer",
+		"Auth": map[string]interface{}{
+			"access_token":       "access",
+			"refresh_token":      "refresh",
+			"expireTime":         farFuture,
+			"refresh_expireTime": farFuture,
+		},
+	}
+	writeJSON(t, filepath.Join(workDir, "data", "config.json"), config)
+	writeJSON(t, filepath.Join(workDir, "data", "state.json"), map[string]interface{}{})
+
+	millURL, _ := url.Parse(ta.mill.URL)
+	defaultTransport := http.DefaultTransport
+	// Legacy api and the auth code proxy are sent to the stand-in too, so no test reaches the internet
+	http.DefaultTransport = redirect{hosts: []string{"api.millnorwaycloud.com", "api.millheat.com", "partners.futurehome.io", "partners-beta.futurehome.io"}, target: millURL, next: defaultTransport}
+	ta.cleanup = append(ta.cleanup, func() { http.DefaultTransport = defaultTransport })
+
+	brokerURI, listener := startBroker(t)
+	ta.brokerURI = brokerURI
+	ta.cleanup = append(ta.cleanup, func() { listener.Close() })
+	ta.mqt = fimpgo.NewMqttTransport(brokerURI, "mill-test", "", "", true, 1, 1)
+	ta.mqt.RegisterChannelWithFilterFunc("replies", ta.replies, func(topic string, addr *fimpgo.Address, msg *fimpgo.FimpMessage) bool {
+		return msg.CorrelationID != ""
+	})
+
+	configs := model.NewConfigs(workDir)
+	states := model.NewStates(workDir)
+	if err := configs.LoadFromFile(); err != nil {
+		ta.close()
+		t.Fatal(err)
+	}
+	if err := states.LoadFromFile(); err != nil {
+		ta.close()
+		t.Fatal(err)
+	}
+	states.SetLocalAddress("d2", ta.heater.URL)
+	ta.Account = NewAccount(model.NewAppLifecycle(), configs, states)
+	ta.InitLifecycle()
+	ta.ctx, ta.cancel = context.WithCancel(context.Background())
+	ta.callCtx, ta.cancelCalls = context.WithCancel(context.Background())
+	ta.rescheduleCh = make(chan struct{}, 1)
+	ta.manager = NewManager(ta.ctx, ta.mqt, workDir)
+	ta.manager.accounts[ta.Instance] = ta.Account
+	ta.schedule, ta.reports = newPollSchedule(configs, states), newReportFilter()
+
+	ta.router = router.NewFromFimpRouter(ta.mqt, ta.Lifecycle, configs, states, ta.manager, &ta.lock)
+	ta.router.Start()
+	ta.manager.startDiscovery()
+	ta.cleanup = append(ta.cleanup, func() {
+		ta.cancel()
+		ta.cancelCalls()
+		ta.router.Stop()
+		ta.manager.stopDiscovery()
+	})
+	if err := ta.mqt.Start(); err != nil {
+		ta.close()
+		t.Fatal(err)
+	}
+	// Transport is stopped before the router, so the router doesn't unsubscribe either
+	ta.cleanup = append(ta.cleanup, ta.mqt.Stop)
+	return ta
+}
+
+// startManager starts logged in account instances on a manager of their own, with its own transport, so stopping
+// them leaves the test account running. The manager works in a new dir, which the caller removes.
+func (ta *testAccount) startManager(t *testing.T, instances ...string) (*Manager, *fimpgo.MqttTransport, string) {
+	t.Helper()
+	workDir, err := ioutil.TempDir("", "mill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	farFuture := time.Now().Add(24*time.Hour).UnixNano() / 1000000
+	mqt := fimpgo.NewMqttTransport(ta.brokerURI, "mill-test-"+strings.Join(instances, "-"), "", "", true, 1, 1)
+	manager := NewManager(context.Background(), mqt, workDir)
+	manager.mux.Lock()
+	defer manager.mux.Unlock()
+	for _, instance := range instances {
+		writeJSON(t, filepath.Join(workDir, "data", "config_"+instance+".json"), map[string]interface{}{
+			"api_backend": "customer",
+			"Auth":        map[string]interface{}{"access_token": "access", "expireTime": farFuture, "refresh_expireTime": farFuture},
+		})
+		writeJSON(t, filepath.Join(workDir, "data", "state_"+instance+".json"), map[string]interface{}{})
+		ac, err := manager.load(instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.start(ac)
+	}
+	// Routers are started before the transport is connected, see broker
+	if err := mqt.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return manager, mqt, workDir
+}
+
+// close stops the router and the stand-ins
+func (ta *testAccount) close() {
+	for i := len(ta.cleanup) - 1; i >= 0; i-- {
+		ta.cleanup[i]()
+	}
+}
+
+func writeJSON(t *testing.T, path string, val interface{}) {
+	body, err := json.Marshal(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, body, 0664); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// send publishes a command to a device service of the account and returns the request
+func (ta *testAccount) send(t *testing.T, deviceID string, service string, msgType string, valueType string, value interface{}) *fimpgo.FimpMessage {
+	t.Helper()
+	msg := fimpgo.NewMessage(msgType, service, valueType, value, nil, nil, nil)
+	addr := &fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: ta.Instance, ServiceName: service, ServiceAddress: model.NewServiceAddress(ta.Instance, "h1", deviceID).String()}
+	if err := ta.mqt.Publish(addr, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// sendAdapter publishes a command to the adapter instance of the account and returns the request
+func (ta *testAccount) sendAdapter(t *testing.T, msgType string) *fimpgo.FimpMessage {
+	t.Helper()
+	msg := fimpgo.NewNullMessage(msgType, model.ServiceName, nil, nil, nil)
+	msg.ResponseToTopic = "pt:j1/mt:rsp/rt:app/rn:mill-test/ad:1"
+	addr := &fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: ta.Instance}
+	if err := ta.mqt.Publish(addr, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// waitReplies waits for a reply to each request. accept tells if a reply is the one expected, replies it
+// rejects are skipped.
+func (ta *testAccount) waitReplies(t *testing.T, requests []*fimpgo.FimpMessage, accept func(reply *fimpgo.FimpMessage) bool) map[string]*fimpgo.FimpMessage {
+	t.Helper()
+	pending := make(map[string]bool)
+	for _, req := range requests {
+		pending[req.UID] = true
+	}
+	replies := make(map[string]*fimpgo.FimpMessage)
+	timeout := time.After(waitTimeout)
+	for len(pending) > 0 {
+		select {
+		case msg := <-ta.replies:
+			if pending[msg.Payload.CorrelationID] && accept(msg.Payload) {
+				delete(pending, msg.Payload.CorrelationID)
+				replies[msg.Payload.CorrelationID] = msg.Payload
+			}
+		case <-timeout:
+			t.Fatalf("%d requests were not answered", len(pending))
+		}
+	}
+	return replies
+}
+
+// assertUnlocked fails if the account lock can't be taken
+func (ta *testAccount) assertUnlocked(t *testing.T, while string) {
+	t.Helper()
+	locked := make(chan struct{})
+	go func() {
+		ta.lock.Lock()
+		ta.lock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("account lock is held while %s", while)
+	}
+}
@@ -0,0 +1,286 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/model"
+	"github.com/thingsplex/mill/router"
+)
+
+// Account is a Mill account served by its own adapter instance, with its own tokens, topology, router and poller
+type Account struct {
+	Instance  string
+	Lifecycle *model.Lifecycle
+	Configs   *model.Configs
+	States    *model.States
+	router    *router.FromFimpRouter
+	// lock is held by router and poller while they use Configs and States
+	lock sync.Mutex
+	// ctx is cancelled when the account is stopped or the adapter shuts down, poller and connectivity monitor stop
+	// after the current poll or probe
+	ctx    context.Context
+	cancel context.CancelFunc
+	// callCtx is passed to calls to Mill, it is cancelled when stop gives up waiting for them
+	callCtx     context.Context
+	cancelCalls context.CancelFunc
+	// running counts poller and connectivity monitor, stop waits for them
+	running sync.WaitGroup
+	monitor *connectivityMonitor
+	// rescheduleCh wakes the poller when poll time is changed
+	rescheduleCh chan struct{}
+	// unavailable is set while devices are reported down because Mill can't be reached
+	unavailable bool
+}
+
+// NewAccount wraps loaded configs and states of an adapter instance
+func NewAccount(lifecycle *model.Lifecycle, configs *model.Configs, states *model.States) *Account {
+	instance := configs.InstanceAddress
+	if instance == "" {
+		instance = "1"
+	}
+	// Lists from the last run are used until the first poll succeeds
+	states.HomeCollection, states.RoomCollection, states.DeviceCollection, states.IndependentDeviceCollection = mill.DecodeLists(states.HomeCollection, states.RoomCollection, states.DeviceCollection, states.IndependentDeviceCollection)
+	return &Account{Instance: instance, Lifecycle: lifecycle, Configs: configs, States: states, monitor: newConnectivityMonitor(lifecycle)}
+}
+
+// InitLifecycle sets config, connection and auth states from loaded configs. A configured account is connecting
+// until the first call to Mill shows whether it can be reached.
+func (ac *Account) InitLifecycle() {
+	if ac.Configs.IsConfigured() {
+		ac.Lifecycle.SetConfigState(model.ConfigStateConfigured)
+		ac.Lifecycle.SetAppState(model.AppStateRunning, nil)
+		ac.Lifecycle.SetConnectionState(model.ConnStateConnecting)
+	} else {
+		ac.Lifecycle.SetConfigState(model.ConfigStateNotConfigured)
+		ac.Lifecycle.SetAppState(model.AppStateNotConfigured, nil)
+		ac.Lifecycle.SetConnectionState(model.ConnStateDisconnected)
+	}
+
+	if ac.Configs.IsAuthenticated() {
+		ac.Lifecycle.SetAuthState(model.AuthStateAuthenticated)
+	} else {
+		ac.Lifecycle.SetAuthState(model.AuthStateNotAuthenticated)
+	}
+}
+
+// stopTimeout is how long stop waits for poller and connectivity monitor before their calls to Mill are cancelled
+const stopTimeout = 10 * time.Second
+
+// Manager runs all Mill accounts on the hub. Instance 1 is the main account, additional accounts are
+// stored in data/config_<instance>.json and data/state_<instance>.json.
+type Manager struct {
+	mux      sync.Mutex
+	ctx      context.Context
+	mqt      *fimpgo.MqttTransport
+	workDir  string
+	accounts map[string]*Account
+	// stopCh stops the discovery responder, running counts it and accounts being removed
+	stopCh  chan struct{}
+	running sync.WaitGroup
+}
+
+// NewManager returns a manager whose accounts run until ctx is cancelled and Stop is called
+func NewManager(ctx context.Context, mqt *fimpgo.MqttTransport, workDir string) *Manager {
+	return &Manager{ctx: ctx, mqt: mqt, workDir: workDir, accounts: make(map[string]*Account), stopCh: make(chan struct{})}
+}
+
+// Start starts router and poller of the main account and of all additional accounts found in data dir,
+// and advertises every account instance to discovery
+func (mg *Manager) Start(main *Account) {
+	mg.mux.Lock()
+	defer mg.mux.Unlock()
+	mg.startDiscovery()
+	mg.start(main)
+	for _, instance := range model.AccountInstances(mg.workDir) {
+		ac, err := mg.load(instance)
+		if err != nil {
+			log.Error("<account> Can't load account instance ", instance, ". Error: ", err)
+			continue
+		}
+		mg.start(ac)
+	}
+}
+
+// AddAccount creates a new, not configured account instance. User logs in on the new instance.
+func (mg *Manager) AddAccount() (string, error) {
+	mg.mux.Lock()
+	defer mg.mux.Unlock()
+	instance := mg.nextInstance()
+	ac, err := mg.load(instance)
+	if err != nil {
+		return "", err
+	}
+	if err := ac.Configs.SaveToFile(); err != nil {
+		return "", err
+	}
+	ac.States.SaveToFile()
+	mg.start(ac)
+	// The new instance is announced right away, so it can be configured without waiting for discovery
+	mg.advertise(instance)
+	return instance, nil
+}
+
+// RemoveAccount stops an additional account instance and deletes its config and state files
+func (mg *Manager) RemoveAccount(instance string) error {
+	mg.mux.Lock()
+	defer mg.mux.Unlock()
+	if instance == "1" {
+		return fmt.Errorf("main account can't be removed")
+	}
+	ac, ok := mg.accounts[instance]
+	if !ok {
+		return fmt.Errorf("account instance %s does not exist", instance)
+	}
+	delete(mg.accounts, instance)
+	// Account is usually removed by its own router, which can't wait for itself to stop. Stop waits for it.
+	mg.running.Add(1)
+	go func() {
+		defer mg.running.Done()
+		ac.stop()
+		ac.Configs.Remove()
+		ac.States.Remove()
+		log.Info("<account> Removed account instance ", instance)
+	}()
+	return nil
+}
+
+// Stop reports every account as terminating, stops discovery and all accounts, waits for calls to Mill in progress
+// and accounts being removed, and saves configs and states
+func (mg *Manager) Stop() {
+	// Accounts are taken first, so no account can be removed while Stop waits for removals
+	mg.mux.Lock()
+	accounts := mg.accounts
+	mg.accounts = make(map[string]*Account)
+	mg.mux.Unlock()
+	for _, ac := range accounts {
+		ac.Lifecycle.SetAppState(model.AppStateTerminate, nil)
+	}
+	mg.stopDiscovery()
+	var wg sync.WaitGroup
+	for _, ac := range accounts {
+		wg.Add(1)
+		go func(ac *Account) {
+			defer wg.Done()
+			ac.stop()
+			ac.lock.Lock()
+			defer ac.lock.Unlock()
+			if err := ac.States.SaveToFile(); err != nil {
+				log.Error("<account> Can't save state of instance ", ac.Instance, ". Error: ", err)
+			}
+			if err := ac.Configs.SaveToFile(); err != nil {
+				log.Error("<account> Can't save config of instance ", ac.Instance, ". Error: ", err)
+			}
+		}(ac)
+	}
+	wg.Wait()
+	log.Info("<account> All accounts stopped")
+}
+
+// Accounts returns instance addresses of all running accounts
+func (mg *Manager) Accounts() []string {
+	mg.mux.Lock()
+	defer mg.mux.Unlock()
+	instances := []string{}
+	for instance := range mg.accounts {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		a, _ := strconv.Atoi(instances[i])
+		b, _ := strconv.Atoi(instances[j])
+		return a < b
+	})
+	return instances
+}
+
+// Reschedule makes the poller of the account instance apply a new poll time
+func (mg *Manager) Reschedule(instance string) {
+	mg.mux.Lock()
+	defer mg.mux.Unlock()
+	if ac, ok := mg.accounts[instance]; ok {
+		ac.reschedule()
+	}
+}
+
+// RecordMillResult updates connectivity of the account instance from the outcome of a call to Mill
+func (mg *Manager) RecordMillResult(instance string, err error) {
+	mg.mux.Lock()
+	ac, ok := mg.accounts[instance]
+	mg.mux.Unlock()
+	if ok && ac.monitor.record(err) {
+		ac.reschedule()
+	}
+}
+
+// reschedule wakes the poller
+func (ac *Account) reschedule() {
+	select {
+	case ac.rescheduleCh <- struct{}{}:
+	default:
+		// Poller is already rescheduling
+	}
+}
+
+func (mg *Manager) load(instance string) (*Account, error) {
+	configs := model.NewInstanceConfigs(mg.workDir, instance)
+	if err := configs.LoadFromFile(); err != nil {
+		return nil, err
+	}
+	states := model.NewInstanceStates(mg.workDir, instance)
+	if err := states.LoadFromFile(); err != nil {
+		return nil, err
+	}
+	ac := NewAccount(model.NewAppLifecycle(), configs, states)
+	ac.InitLifecycle()
+	return ac, nil
+}
+
+func (mg *Manager) start(ac *Account) {
+	ac.router = router.NewFromFimpRouter(mg.mqt, ac.Lifecycle, ac.Configs, ac.States, mg, &ac.lock)
+	ac.router.Start()
+	ac.ctx, ac.cancel = context.WithCancel(mg.ctx)
+	ac.callCtx, ac.cancelCalls = context.WithCancel(context.Background())
+	ac.rescheduleCh = make(chan struct{}, 1)
+	ac.running.Add(2)
+	go ac.runPoller(mg.mqt)
+	go ac.runConnectivityMonitor()
+	mg.accounts[ac.Instance] = ac
+	log.Info("<account> Started account instance ", ac.Instance)
+}
+
+// stop stops router and waits for the poller to complete the current poll, and for a probe in progress. Calls to
+// Mill still in progress after stopTimeout are cancelled.
+func (ac *Account) stop() {
+	ac.cancel()
+	ac.router.Stop()
+	done := make(chan struct{})
+	go func() {
+		ac.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		log.Warn("<account> Cancelling calls to Mill in progress on instance ", ac.Instance)
+		ac.cancelCalls()
+		<-done
+	}
+	ac.cancelCalls()
+}
+
+func (mg *Manager) nextInstance() string {
+	next := 2
+	for instance := range mg.accounts {
+		if n, err := strconv.Atoi(instance); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	return strconv.Itoa(next)
+}
@@ -0,0 +1,392 @@
+package account
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/millocal"
+	"github.com/thingsplex/mill/model"
+	"github.com/thingsplex/mill/router"
+)
+
+// runPoller fetches the Mill account every poll_time_min minutes, reads devices polled faster in between, and
+// publishes reports until the account is stopped
+func (ac *Account) runPoller(mqtt *fimpgo.MqttTransport) {
+	defer ac.running.Done()
+	configs, states, appLifecycle := ac.Configs, ac.States, ac.Lifecycle
+
+	if !appLifecycle.WaitForStateContext(ac.ctx, "poller", model.AppStateRunning) {
+		return
+	}
+	log.Info("<poller> Starting poller for account instance ", ac.Instance)
+	reports := newReportFilter()
+	schedule := newPollSchedule(configs, states)
+	select {
+	case <-ac.ctx.Done():
+		return
+	case <-time.After(schedule.firstPollDelay()):
+	}
+	for {
+		if !ac.poll(mqtt, schedule, reports) || !ac.waitForPoll(schedule) {
+			return
+		}
+	}
+}
+
+// poll fetches the account or reads the devices that are due, and reports due devices. Calls to Mill and heaters
+// are made without holding the account lock. Returns false if the account was stopped.
+func (ac *Account) poll(mqtt *fimpgo.MqttTransport, schedule *pollSchedule, reports *reportFilter) bool {
+	configs, states := ac.Configs, ac.States
+	if !ac.refreshTokens() {
+		return false
+	}
+	// Configs and states are shared with the router, they are only used while holding the account lock
+	ac.lock.Lock()
+	backend := mill.NewBackend(configs.ApiBackend)
+	ns := model.NetworkService{InstanceAddress: ac.Instance, RoomMapping: configs.RoomMapping, PowerLevel: backend.SupportsPowerLevel(),
+		ModeControl: backend.SupportsModeControl(), LocalDevices: states.LocalDevices}
+	wasStale := states.IsStale()
+	accessToken := configs.Auth.AccessToken
+	now := time.Now()
+	fetch := schedule.fetchDue(now)
+	var reads []deviceRef
+	localAddrs := make(map[string]string)
+	for _, device := range states.DeviceCollection {
+		deviceId := model.DeviceID(device)
+		if states.IsExcluded(deviceId) || !schedule.isDue(deviceId, now, fetch) {
+			continue
+		}
+		if localAddr, local := states.LocalAddress(deviceId); local {
+			localAddrs[deviceId] = localAddr
+		} else if !fetch && accessToken != "" {
+			// Devices polled faster than the account are read on their own
+			val := reflect.ValueOf(device)
+			reads = append(reads, deviceRef{deviceID: deviceId, homeID: val.FieldByName("HomeID").String(), roomID: val.FieldByName("RoomID").String()})
+		}
+	}
+	ac.lock.Unlock()
+	var fresh map[string]interface{}
+	if fetch {
+		if !ac.fetch(mqtt, backend, accessToken, wasStale, ns, schedule, reports) {
+			return false
+		}
+	} else if fresh = ac.readDevices(backend, accessToken, reads); ac.callCtx.Err() != nil {
+		return false
+	}
+	local := readLocal(localAddrs)
+
+	ac.lock.Lock()
+	threshold, heartbeat := configs.TempThreshold(), configs.Heartbeat()
+	for i := 0; i < len(states.DeviceCollection); i++ {
+		deviceVal := states.DeviceCollection[i]
+		deviceId := model.DeviceID(deviceVal)
+		if states.IsExcluded(deviceId) || !schedule.isDue(deviceId, now, fetch) {
+			continue
+		}
+		if device, ok := fresh[deviceId]; ok {
+			deviceVal = device
+		}
+		heating := model.IsHeating(deviceVal)
+		changed := ac.reportDevice(mqtt, reports, deviceVal, local[deviceId], threshold, heartbeat)
+		schedule.polled(deviceId, now, changed, heating)
+	}
+	states.SaveToFile()
+	ac.lock.Unlock()
+	return true
+}
+
+// deviceRef addresses a device read on its own
+type deviceRef struct {
+	deviceID string
+	homeID   string
+	roomID   string
+}
+
+// refreshTokens gets new tokens if expires_in is exceeded. Mill is called without holding the account lock, tokens
+// changed by a login or the router in the meantime are kept. Returns false if the account was stopped.
+func (ac *Account) refreshTokens() bool {
+	configs, states, appLifecycle := ac.Configs, ac.States, ac.Lifecycle
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	if configs.Auth.ExpireTime == 0 {
+		return true
+	}
+	log.Debug("Checking expireTime")
+	millis := time.Now().UnixNano() / 1000000
+	if millis > configs.Auth.RefreshExpireTime {
+		log.Error("30 day refreshExpireTime has expired. Restard adapter or send cmd.auth.login")
+		appLifecycle.SetError(model.ErrorSourceAuth, model.ErrCodeNotLoggedIn, "Mill login expired, please log in again")
+		return true
+	}
+	if millis <= configs.Auth.ExpireTime {
+		log.Debug("expiretime is OK")
+		return true
+	}
+	log.Debug("Trying to set new tokens")
+	backend := mill.NewBackend(configs.ApiBackend)
+	oldRefreshToken := configs.Auth.RefreshToken
+	ac.lock.Unlock()
+	accessToken, refreshToken, expireTime, refreshExpireTime, err := backend.RefreshToken(ac.callCtx, oldRefreshToken)
+	ac.lock.Lock()
+	if ac.callCtx.Err() != nil {
+		// Refresh was cancelled when the account was stopped
+		return false
+	}
+	if configs.Auth.RefreshToken != oldRefreshToken {
+		log.Debug("<poller> Tokens changed while refreshing, keeping the new tokens")
+		return true
+	}
+	log.Debug(err)
+	if err == nil {
+		configs.Auth.AccessToken = accessToken
+		configs.Auth.RefreshToken = refreshToken
+		configs.Auth.ExpireTime = expireTime
+		configs.Auth.RefreshExpireTime = refreshExpireTime
+		appLifecycle.ClearError(model.ErrorSourceAuth)
+	} else {
+		configs.Auth.ExpireTime = 1
+		appLifecycle.SetError(model.ErrorSourceAuth, model.ErrCodeNotLoggedIn, "Can't refresh Mill login: "+err.Error())
+	}
+	states.SaveToFile()
+	configs.SaveToFile()
+	return true
+}
+
+// readLocal reads heaters with local api, given by device ID. Heaters that can't be read are left out, they are
+// reported with cloud values.
+func readLocal(localAddrs map[string]string) map[string]*millocal.ControlStatus {
+	statuses := make(map[string]*millocal.ControlStatus)
+	for deviceId, localAddr := range localAddrs {
+		status, err := millocal.NewClient(localAddr).GetControlStatus()
+		if err != nil {
+			log.Warn("<poller> Can't poll device ", deviceId, " locally, using cloud values. Error: ", err)
+			continue
+		}
+		statuses[deviceId] = status
+	}
+	return statuses
+}
+
+// readDevices reads devices polled faster than the account. Devices listed by the same call are read together, a
+// room on the open api and a home on the customer api, and calls wait for the rate limit shared with commands.
+// Devices that can't be read are reported with values of the last fetch.
+func (ac *Account) readDevices(backend mill.Backend, accessToken string, reads []deviceRef) map[string]interface{} {
+	fresh := make(map[string]interface{})
+	read := make(map[deviceRef]bool)
+	for _, ref := range reads {
+		group := deviceRef{homeID: ref.homeID, roomID: ref.roomID}
+		if _, ok := fresh[ref.deviceID]; ok || read[group] {
+			continue
+		}
+		read[group] = true
+		router.WaitForMill()
+		devices, err := backend.ReadDevices(ac.callCtx, accessToken, ref.homeID, ref.roomID)
+		if ac.callCtx.Err() != nil {
+			return fresh
+		}
+		ac.monitor.record(err)
+		if err != nil {
+			log.Error("<poller> Can't read devices of home ", ref.homeID, " room ", ref.roomID, ". Error: ", err)
+			return fresh
+		}
+		// Devices missing from the list are found by the next fetch
+		for _, device := range devices {
+			fresh[string(device.DeviceID)] = device
+		}
+	}
+	return fresh
+}
+
+// fetch fetches the whole account, announces topology changes and reports availability. Returns false if the
+// account was stopped during the fetch.
+func (ac *Account) fetch(mqtt *fimpgo.MqttTransport, backend mill.Backend, accessToken string, wasStale bool, ns model.NetworkService, schedule *pollSchedule, reports *reportFilter) bool {
+	configs, states := ac.Configs, ac.States
+	hc, rc, dc, idc, err := backend.UpdateLists(ac.callCtx, accessToken, nil, nil, nil, nil)
+	if ac.callCtx.Err() != nil {
+		// Fetch was cancelled when the account was stopped
+		return false
+	}
+	if accessToken != "" {
+		// Connection state follows the outcome, this may check the internet connection
+		ac.monitor.record(err)
+	}
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	schedule.fetched(time.Now())
+	if err != nil {
+		// Last good lists are kept, reports are flagged as stale until Mill can be reached again
+		log.Error("<poller> Can't update lists. Error: ", err)
+		if accessToken != "" {
+			states.ListsFailed(time.Now())
+		}
+	} else {
+		states.SetLists(hc, rc, dc, idc, time.Now())
+	}
+	states.FilterHomes(configs.SelectedHomes)
+	if states.IsStale() != wasStale {
+		// Publish everything again, so consumers see the new stale flag
+		reports.reset()
+	}
+	ac.reportAvailability(mqtt, states.OutageLasted(configs.OutageGrace(), time.Now()))
+
+	// Announce devices added to or removed from the Mill account, and devices that were renamed or moved
+	changes := states.ReconcileTopology(time.Now(), configs.RemovalGrace())
+	announce := append(changes.Added, changes.Changed...)
+	migrate := states.NeedsAddressMigration() && err == nil
+	if migrate {
+		// Things keep their address, so Futurehome keeps their room placement and only updates service addresses
+		log.Info("<poller> Announcing devices with service address scheme ", model.AddressScheme)
+		announce = nil
+		for i := range states.DeviceCollection {
+			announce = append(announce, i)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, i := range announce {
+		deviceId := model.DeviceID(states.DeviceCollection[i])
+		if seen[deviceId] || states.IsExcluded(deviceId) {
+			continue
+		}
+		seen[deviceId] = true
+		inclReport := ns.SendInclusionReport(i, states.DeviceCollection)
+		msg := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: ac.Instance}
+		mqtt.Publish(adr, msg)
+	}
+	if migrate {
+		states.AddressScheme = model.AddressScheme
+	}
+	for _, deviceId := range changes.Removed {
+		if states.IsExcluded(deviceId) {
+			continue
+		}
+		schedule.forget(deviceId)
+		log.Info("<poller> Device ", deviceId, " was removed from the Mill account")
+		val := map[string]interface{}{
+			"address": deviceId,
+		}
+		msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, nil)
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: ac.Instance}
+		mqtt.Publish(adr, msg)
+	}
+
+	return true
+}
+
+// waitForPoll waits until the next fetch or device read is due. A new poll time or a command starts a new wait right away.
+// Returns false if the account is stopped.
+func (ac *Account) waitForPoll(schedule *pollSchedule) bool {
+	for {
+		ac.lock.Lock()
+		wait := schedule.nextWait(time.Now())
+		ac.lock.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ac.ctx.Done():
+			timer.Stop()
+			return false
+		case <-ac.rescheduleCh:
+			timer.Stop()
+			log.Debug("<poller> Rescheduling account instance ", ac.Instance)
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// reportDevice publishes reports of a device from DeviceCollection. local is the status read from a heater with local
+// api, nil for other devices. Returns true if any value changed.
+func (ac *Account) reportDevice(mqtt *fimpgo.MqttTransport, reports *reportFilter, deviceVal interface{}, local *millocal.ControlStatus, threshold float64, heartbeat time.Duration) bool {
+	states := ac.States
+	device := reflect.ValueOf(deviceVal)
+	deviceId := device.FieldByName("DeviceID").String()
+	svcAddr := model.NewServiceAddress(ac.Instance, device.FieldByName("HomeID").String(), deviceId).String()
+	deviceType := device.FieldByName("DeviceType").String()
+	if deviceType == model.DeviceTypeSocket {
+		// Sockets are plain on/off switches
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: ac.Instance, ServiceName: "out_bin_switch", ServiceAddress: svcAddr}
+		on := device.FieldByName("PowerStatus").Int() == 1
+		msg := fimpgo.NewMessage("evt.binary.report", "out_bin_switch", fimpgo.VTypeBool, on, states.ReportProps(nil), nil, nil)
+		return reports.publish(mqtt, adr, msg, on, 0, heartbeat)
+	}
+	currentTemp := device.FieldByName("CurrentTemp").Interface().(float32)
+	setpointTemp := strconv.FormatFloat(float64(device.FieldByName("SetpointTemp").Interface().(float32)), 'f', -1, 32)
+	// Prefer values read directly from heaters with local api, cloud values can be several minutes old
+	if local != nil {
+		currentTemp = local.AmbientTemperature
+		setpointTemp = strconv.FormatFloat(float64(local.SetTemperature), 'f', -1, 32)
+	}
+	changed := false
+	tempVal := currentTemp
+	props := fimpgo.Props{}
+	props["unit"] = "C"
+
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: ac.Instance, ServiceName: "sensor_temp", ServiceAddress: svcAddr}
+	msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, tempVal, states.ReportProps(props), nil, nil)
+	changed = reports.publish(mqtt, adr, msg, tempVal, threshold, heartbeat) || changed
+
+	if deviceType == model.DeviceTypeSensor {
+		// Sense sensors have no setpoint, only air quality values
+		for _, service := range model.AirQualityServices {
+			val, unit, _ := model.SensorValue(deviceVal, service)
+			adr = &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: ac.Instance, ServiceName: service, ServiceAddress: svcAddr}
+			msg = fimpgo.NewMessage("evt.sensor.report", service, fimpgo.VTypeFloat, val, states.ReportProps(fimpgo.Props{"unit": unit}), nil, nil)
+			changed = reports.publish(mqtt, adr, msg, val, 0, heartbeat) || changed
+		}
+		return changed
+	}
+
+	var setpointProps fimpgo.Props
+	if cmd, ok := states.Pending(deviceId, "thermostat"); ok {
+		// Polled value may be older than the command, report the commanded value until it is confirmed
+		setpointTemp = cmd.Value
+		setpointProps = fimpgo.Props{"state": model.CommandStatePending}
+	}
+	setpointVal := map[string]interface{}{
+		"type": "heat",
+		"temp": setpointTemp,
+		"unit": "C",
+	}
+	if setpointTemp != "0" {
+		adr = &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: ac.Instance, ServiceName: "thermostat", ServiceAddress: svcAddr}
+		value := setpointTemp + fmt.Sprint(setpointProps)
+		msg = fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, setpointVal, states.ReportProps(setpointProps), nil, nil)
+		changed = reports.publish(mqtt, adr, msg, value, 0, heartbeat) || changed
+	}
+	if deviceType == model.DeviceTypeOilHeater && mill.NewBackend(ac.Configs.ApiBackend).SupportsPowerLevel() {
+		adr = &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: ac.Instance, ServiceName: "out_lvl_switch", ServiceAddress: svcAddr}
+		level := device.FieldByName("PowerLevel").Int()
+		msg = fimpgo.NewMessage("evt.lvl.report", "out_lvl_switch", fimpgo.VTypeInt, level, states.ReportProps(nil), nil, nil)
+		changed = reports.publish(mqtt, adr, msg, level, 0, heartbeat) || changed
+	}
+	return changed
+}
+
+// reportAvailability reports all devices down when Mill has been unreachable for longer than outage_grace_min,
+// and up again when Mill can be reached
+func (ac *Account) reportAvailability(mqtt *fimpgo.MqttTransport, down bool) {
+	if down == ac.unavailable {
+		return
+	}
+	ac.unavailable = down
+	status := model.NodeStatusUp
+	if down {
+		status = model.NodeStatusDown
+		log.Warn("<poller> Mill has been unreachable since ", time.Unix(ac.States.OutageSince, 0).Format(time.RFC3339), ", reporting devices down")
+	}
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: ac.Instance}
+	for _, device := range ac.States.DeviceCollection {
+		deviceId := model.DeviceID(device)
+		if ac.States.IsExcluded(deviceId) {
+			continue
+		}
+		val := model.NodeReport{Address: deviceId, Status: status}
+		msg := fimpgo.NewMessage("evt.network.node_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, nil)
+		mqtt.Publish(adr, msg)
+	}
+}
@@ -0,0 +1,69 @@
+package account
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+)
+
+// publishedReport is the last value the poller published on a service of a device
+type publishedReport struct {
+	value interface{}
+	at    time.Time
+}
+
+// reportFilter skips poll reports that don't tell consumers anything new. A report is published when its value
+// changed by more than the threshold, or as heartbeat when the last report is older than the heartbeat interval.
+type reportFilter struct {
+	last map[string]publishedReport
+}
+
+func newReportFilter() *reportFilter {
+	return &reportFilter{last: make(map[string]publishedReport)}
+}
+
+// reset forgets published reports, so everything is published again
+func (rf *reportFilter) reset() {
+	rf.last = make(map[string]publishedReport)
+}
+
+// publish sends msg to adr unless value is within threshold of the last published value and heartbeat is not due.
+// Returns true if the value changed since the last report.
+func (rf *reportFilter) publish(mqtt *fimpgo.MqttTransport, adr *fimpgo.Address, msg *fimpgo.FimpMessage, value interface{}, threshold float64, heartbeat time.Duration) bool {
+	key := adr.ServiceAddress + "/" + adr.ServiceName + "/" + msg.Type
+	now := time.Now()
+	last, ok := rf.last[key]
+	valueChanged := !ok || changed(last.value, value, threshold)
+	if !valueChanged && now.Sub(last.at) < heartbeat {
+		return false
+	}
+	rf.last[key] = publishedReport{value: value, at: now}
+	mqtt.Publish(adr, msg)
+	return valueChanged
+}
+
+// changed compares numbers by threshold and other values by equality
+func changed(old interface{}, new interface{}, threshold float64) bool {
+	oldNum, oldOk := number(old)
+	newNum, newOk := number(new)
+	if oldOk && newOk {
+		return math.Abs(newNum-oldNum) > threshold
+	}
+	return fmt.Sprint(old) != fmt.Sprint(new)
+}
+
+func number(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,66 @@
+package account
+
+import (
+	"testing"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+)
+
+func TestReportFilter(t *testing.T) {
+	// Transport is not connected, the filter is checked by the reports it records as published
+	mqt := fimpgo.NewMqttTransport("tcp://localhost:1883", "mill-test", "", "", true, 1, 1)
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ServiceName: "sensor_temp", ServiceAddress: "1_h1_d1"}
+	heartbeat := time.Hour
+	for name, test := range map[string]struct {
+		last      interface{}
+		lastAge   time.Duration
+		value     interface{}
+		threshold float64
+		published bool
+		changed   bool
+	}{
+		"first report":               {value: float32(21.5), threshold: 0.5, published: true, changed: true},
+		"same value":                 {last: float32(21.5), lastAge: time.Minute, value: float32(21.5), threshold: 0.5},
+		"change within threshold":    {last: float32(21.5), lastAge: time.Minute, value: float32(21.9), threshold: 0.5},
+		"change past threshold":      {last: float32(21.5), lastAge: time.Minute, value: float32(22.1), threshold: 0.5, published: true, changed: true},
+		"drop past threshold":        {last: float32(21.5), lastAge: time.Minute, value: float32(20.9), threshold: 0.5, published: true, changed: true},
+		"heartbeat due":              {last: float32(21.5), lastAge: heartbeat, value: float32(21.5), threshold: 0.5, published: true},
+		"heartbeat due within delta": {last: float32(21.5), lastAge: 2 * heartbeat, value: float32(21.7), threshold: 0.5, published: true},
+		"same setpoint":              {last: "22", lastAge: time.Minute, value: "22"},
+		"new setpoint":               {last: "22", lastAge: time.Minute, value: "21.5", published: true, changed: true},
+		"switch turned off":          {last: true, lastAge: time.Minute, value: false, published: true, changed: true},
+		"power level as int":         {last: int64(2), lastAge: time.Minute, value: int64(2)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rf := newReportFilter()
+			msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, test.value, nil, nil, nil)
+			key := adr.ServiceAddress + "/" + adr.ServiceName + "/" + msg.Type
+			lastAt := time.Now().Add(-test.lastAge)
+			if test.last != nil {
+				rf.last[key] = publishedReport{value: test.last, at: lastAt}
+			}
+			changed := rf.publish(mqt, adr, msg, test.value, test.threshold, heartbeat)
+			published := rf.last[key].at.After(lastAt)
+			if published != test.published || changed != test.changed {
+				t.Errorf("report was published %v and changed %v, expected %v and %v", published, changed, test.published, test.changed)
+			}
+		})
+	}
+}
+
+func TestReportFilterReset(t *testing.T) {
+	mqt := fimpgo.NewMqttTransport("tcp://localhost:1883", "mill-test", "", "", true, 1, 1)
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ServiceName: "sensor_temp", ServiceAddress: "1_h1_d1"}
+	msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, float32(21.5), nil, nil, nil)
+	rf := newReportFilter()
+	rf.publish(mqt, adr, msg, float32(21.5), 0.5, time.Hour)
+	if rf.publish(mqt, adr, msg, float32(21.5), 0.5, time.Hour) {
+		t.Fatal("same value was reported as changed")
+	}
+	// Stale flag changed, everything is published again
+	rf.reset()
+	if !rf.publish(mqt, adr, msg, float32(21.5), 0.5, time.Hour) {
+		t.Error("report was filtered after reset")
+	}
+}
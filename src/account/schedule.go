@@ -0,0 +1,173 @@
+package account
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/thingsplex/mill/model"
+)
+
+const (
+	// fastPollInterval is used for a while after a command, and while a heater is heating
+	fastPollInterval = time.Minute
+	fastPollWindow   = 10 * time.Minute
+	// Devices with stable values are polled up to maxBackoff times less often than poll_time_min
+	maxBackoff            = 4
+	stablePollsPerBackoff = 3
+	// pollJitter spreads polls by up to 10%, so hubs started at the same time don't poll Mill in lockstep
+	pollJitter = 0.1
+	// minPollWait keeps the poller from spinning when several devices are due at nearly the same time
+	minPollWait = 10 * time.Second
+	// firstPollJitter is the longest delay of the first poll, so hubs powered on together don't poll Mill at once
+	firstPollJitter = time.Minute
+)
+
+// devicePoll is the polling history of a device
+type devicePoll struct {
+	at      time.Time
+	stable  int
+	heating bool
+	jitter  float64
+}
+
+// pollSchedule decides when the account is fetched and when each device is polled. The whole account is fetched
+// every poll_time_min minutes, and devices are reported with the fetch. Devices are polled faster right after a
+// command or while heating, and slower while their values don't change. device_poll_time overrides this. Devices
+// polled faster than the account is fetched are read on their own between fetches.
+type pollSchedule struct {
+	configs *model.Configs
+	states  *model.States
+	devices map[string]*devicePoll
+	rand    *rand.Rand
+	// fetchedAt is when the whole account was last fetched, the next fetch is fetchJitter times poll_time_min later
+	fetchedAt   time.Time
+	fetchJitter float64
+}
+
+func newPollSchedule(configs *model.Configs, states *model.States) *pollSchedule {
+	return &pollSchedule{configs: configs, states: states, devices: make(map[string]*devicePoll), rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// firstPollDelay returns a random delay before the first poll
+func (ps *pollSchedule) firstPollDelay() time.Duration {
+	return time.Duration(ps.rand.Int63n(int64(firstPollJitter)))
+}
+
+// baseInterval returns how long after its last poll the device is polled again, without jitter
+func (ps *pollSchedule) baseInterval(deviceID string, dp *devicePoll, now time.Time) time.Duration {
+	if override, ok := ps.configs.DevicePollInterval(deviceID); ok {
+		return override
+	}
+	base := ps.configs.PollInterval()
+	interval := base
+	if dp.heating || now.Sub(ps.states.LastCommand(deviceID)) < fastPollWindow {
+		if fastPollInterval < base {
+			interval = fastPollInterval
+		}
+	} else {
+		backoff := 1 + dp.stable/stablePollsPerBackoff
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		interval = base * time.Duration(backoff)
+		if interval > model.MaxPollTime*time.Minute {
+			interval = model.MaxPollTime * time.Minute
+		}
+		// Reports are only sent again when the device is polled, so backoff must not delay the heartbeat. The
+		// longest jitter is taken off, and the interval is never shorter than without backoff.
+		if heartbeat := time.Duration(float64(ps.configs.Heartbeat()) / (1 + pollJitter)); interval > heartbeat {
+			interval = heartbeat
+			if interval < base {
+				interval = base
+			}
+		}
+	}
+	return interval
+}
+
+// interval returns how long after its last poll the device is polled again
+func (ps *pollSchedule) interval(deviceID string, now time.Time) time.Duration {
+	dp, ok := ps.devices[deviceID]
+	if !ok {
+		return 0
+	}
+	return time.Duration(float64(ps.baseInterval(deviceID, dp, now)) * dp.jitter)
+}
+
+// readAlone tells if the device is polled faster than the account is fetched, so it is read on its own between fetches
+func (ps *pollSchedule) readAlone(deviceID string, now time.Time) bool {
+	dp, ok := ps.devices[deviceID]
+	return ok && ps.baseInterval(deviceID, dp, now) < ps.configs.PollInterval()
+}
+
+// isDue tells if the device should be polled now. When the account is fetched, devices that would be due before
+// half of the time to the next fetch has passed are polled with it. Between fetches only devices read alone are due.
+func (ps *pollSchedule) isDue(deviceID string, now time.Time, fetching bool) bool {
+	dp, ok := ps.devices[deviceID]
+	if !ok {
+		return true
+	}
+	due := dp.at.Add(ps.interval(deviceID, now))
+	if fetching {
+		return !now.Add(ps.configs.PollInterval() / 2).Before(due)
+	}
+	return ps.readAlone(deviceID, now) && !now.Before(due)
+}
+
+// polled records a poll of the device. changed tells if any reported value changed.
+func (ps *pollSchedule) polled(deviceID string, now time.Time, changed bool, heating bool) {
+	dp, ok := ps.devices[deviceID]
+	if !ok {
+		dp = &devicePoll{}
+		ps.devices[deviceID] = dp
+	}
+	if changed {
+		dp.stable = 0
+	} else {
+		dp.stable++
+	}
+	dp.at, dp.heating = now, heating
+	dp.jitter = ps.newJitter()
+}
+
+// fetchDue tells if the whole account should be fetched now
+func (ps *pollSchedule) fetchDue(now time.Time) bool {
+	return ps.fetchedAt.IsZero() || !now.Before(ps.nextFetch())
+}
+
+// fetched records a fetch of the whole account
+func (ps *pollSchedule) fetched(now time.Time) {
+	ps.fetchedAt = now
+	ps.fetchJitter = ps.newJitter()
+}
+
+func (ps *pollSchedule) nextFetch() time.Time {
+	return ps.fetchedAt.Add(time.Duration(float64(ps.configs.PollInterval()) * ps.fetchJitter))
+}
+
+// newJitter returns a factor that spreads polls by up to pollJitter
+func (ps *pollSchedule) newJitter() float64 {
+	return 1 - pollJitter + 2*pollJitter*ps.rand.Float64()
+}
+
+// forget removes a device that is no longer on the Mill account
+func (ps *pollSchedule) forget(deviceID string) {
+	delete(ps.devices, deviceID)
+}
+
+// nextWait returns time until the next fetch, or until the next device read alone is due
+func (ps *pollSchedule) nextWait(now time.Time) time.Duration {
+	wait := ps.nextFetch().Sub(now)
+	for deviceID, dp := range ps.devices {
+		if !ps.readAlone(deviceID, now) {
+			continue
+		}
+		if due := dp.at.Add(ps.interval(deviceID, now)).Sub(now); due < wait {
+			wait = due
+		}
+	}
+	if wait < minPollWait {
+		wait = minPollWait
+	}
+	return wait
+}
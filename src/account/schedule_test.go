@@ -0,0 +1,33 @@
+package account
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thingsplex/mill/model"
+)
+
+func TestBackoffKeepsHeartbeat(t *testing.T) {
+	// Longest jitter is taken off the heartbeat
+	hour := time.Hour
+	beforeHeartbeat := time.Duration(float64(hour) / (1 + pollJitter))
+	for name, test := range map[string]struct {
+		pollTime  string
+		heartbeat string
+		expected  time.Duration
+	}{
+		"backoff below heartbeat":  {pollTime: "5", heartbeat: "60", expected: 20 * time.Minute},
+		"backoff past heartbeat":   {pollTime: "30", heartbeat: "60", expected: beforeHeartbeat},
+		"poll time past heartbeat": {pollTime: "90", heartbeat: "60", expected: 90 * time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			configs := &model.Configs{PollTimeMin: test.pollTime, HeartbeatMin: test.heartbeat}
+			ps := newPollSchedule(configs, &model.States{})
+			// Values of the device haven't changed for a long time
+			dp := &devicePoll{stable: 100 * stablePollsPerBackoff}
+			if interval := ps.baseInterval("d1", dp, time.Now()); interval != test.expected {
+				t.Errorf("device is polled every %v, expected %v", interval, test.expected)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ module github.com/thingsplex/mill
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/futurehomeno/fimpgo v1.5.3
 	github.com/sirupsen/logrus v1.3.0
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
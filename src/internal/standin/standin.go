@@ -0,0 +1,127 @@
+// Package standin serves canned HTTP responses in tests, in place of Mill cloud and the local api of heaters
+package standin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// WaitTimeout is how long WaitArrived waits for a held request
+const WaitTimeout = 10 * time.Second
+
+// Response is a canned answer, status 0 means 200
+type Response struct {
+	Status int
+	Body   string
+}
+
+// OK is a response with http 200
+func OK(body string) Response {
+	return Response{Body: body}
+}
+
+// Responses turns bodies by route into responses with http 200
+func Responses(bodies map[string]string) map[string]Response {
+	responses := make(map[string]Response)
+	for route, body := range bodies {
+		responses[route] = OK(body)
+	}
+	return responses
+}
+
+// Request is a request received by the server
+type Request struct {
+	Query  string
+	Header http.Header
+	Body   string
+}
+
+// Server serves canned responses by method and path, like "GET /houses", and records the requests. Unknown routes
+// answer 404. Requests to held routes wait until they are released.
+type Server struct {
+	*httptest.Server
+	mux       sync.Mutex
+	responses map[string]Response
+	requests  map[string][]Request
+	held      map[string]chan struct{}
+	// arrived receives routes of held requests when they arrive
+	arrived chan string
+}
+
+// New starts a server answering with responses
+func New(responses map[string]Response) *Server {
+	s := &Server{responses: responses, requests: make(map[string][]Request), held: make(map[string]chan struct{}), arrived: make(chan string, 10)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	route := r.Method + " " + r.URL.Path
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mux.Lock()
+	s.requests[route] = append(s.requests[route], Request{Query: r.URL.RawQuery, Header: r.Header, Body: string(body)})
+	resp, ok := s.responses[route]
+	release, held := s.held[route]
+	s.mux.Unlock()
+	if held {
+		s.arrived <- route
+		<-release
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != 0 {
+		w.WriteHeader(resp.Status)
+	}
+	w.Write([]byte(resp.Body))
+}
+
+// Received returns the requests sent to route
+func (s *Server) Received(route string) []Request {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]Request(nil), s.requests[route]...)
+}
+
+// Count returns the number of requests to route
+func (s *Server) Count(route string) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.requests[route])
+}
+
+// Hold makes requests to route wait until the returned func is called
+func (s *Server) Hold(route string) func() {
+	release := make(chan struct{})
+	s.mux.Lock()
+	s.held[route] = release
+	s.mux.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mux.Lock()
+			delete(s.held, route)
+			s.mux.Unlock()
+			close(release)
+		})
+	}
+}
+
+// WaitArrived waits until a held request to route arrives
+func (s *Server) WaitArrived(t *testing.T, route string) {
+	t.Helper()
+	select {
+	case got := <-s.arrived:
+		if got != route {
+			t.Fatalf("held request to %s arrived, expected %s", got, route)
+		}
+	case <-time.After(WaitTimeout):
+		t.Fatalf("no request to %s", route)
+	}
+}
@@ -1 +1,241 @@
 package mill
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/thingsplex/mill/model"
+)
+
+const (
+	// BackendLegacy is the open api at api.millheat.com, authorized through the Futurehome partner proxy
+	BackendLegacy = "legacy"
+	// BackendCustomer is the newer customer api with direct email/password login
+	BackendCustomer = "customer"
+)
+
+// Backend is a Mill cloud api the adapter can use to read and control devices. Calls give up when ctx is done,
+// or after requestTimeout. Tokens are returned as accessToken, refreshToken, expireTime and refreshExpireTime, times in unix millis.
+type Backend interface {
+	// NeedsAuthCode tells if Login requires an authorization code from the partner proxy
+	NeedsAuthCode() bool
+	Login(ctx context.Context, authCode string, password string, username string) (string, string, int64, int64, error)
+	RefreshToken(ctx context.Context, refreshToken string) (string, string, int64, int64, error)
+	// UpdateLists appends homes, rooms and devices on the account to the given lists. Lists are returned unchanged on
+	// error, also when only some of the lists could be read.
+	UpdateLists(ctx context.Context, accessToken string, hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}) (homelist []interface{}, roomlist []interface{}, devicelist []interface{}, independentdevicelist []interface{}, err error)
+	// ReadDevice reads a device with a single call, from the device list of its room, or of independent devices of
+	// its home if roomID is empty
+	ReadDevice(ctx context.Context, accessToken string, homeID string, roomID string, deviceID string) (Device, error)
+	// ReadDevices makes the call of ReadDevice and returns all devices it lists: the room on the open api and all
+	// rooms of the home on the customer api, or independent devices of the home if roomID is empty
+	ReadDevices(ctx context.Context, accessToken string, homeID string, roomID string) ([]Device, error)
+	// Ping makes the cheapest call that needs the access token, to check that Mill can be used
+	Ping(ctx context.Context, accessToken string) error
+	DeviceControl(ctx context.Context, accessToken string, deviceId string, newTemp string) bool
+	SwitchControl(ctx context.Context, accessToken string, deviceId string, on bool) bool
+	// SupportsPowerLevel tells if SetPowerLevel can be used
+	SupportsPowerLevel() bool
+	// SetPowerLevel selects power level of oil heaters, from model.MinPowerLevel to model.MaxPowerLevel
+	SetPowerLevel(ctx context.Context, accessToken string, deviceId string, level int) bool
+	// SupportsDecimalSetpoint tells if DeviceControl takes setpoints with decimals, otherwise only whole degrees
+	SupportsDecimalSetpoint() bool
+	// SupportsModeControl tells if HeaterModeControl can be used
+	SupportsModeControl() bool
+	// HeaterModeControl turns a heater off, or back on to its setpoint
+	HeaterModeControl(ctx context.Context, accessToken string, deviceId string, on bool) bool
+}
+
+// ErrUnauthorized is returned when Mill rejects the access token, and the user has to log in again. It is defined
+// in model, so app state can tell auth errors from other errors.
+var ErrUnauthorized = model.ErrUnauthorized
+
+// NewBackend returns backend by name. Unknown names fall back to the legacy api.
+func NewBackend(name string) Backend {
+	switch name {
+	case BackendCustomer:
+		return NewCustomerBackend()
+	default:
+		return NewLegacyBackend()
+	}
+}
+
+// ID is a home, room or device id. Legacy api uses numbers while customer api uses strings.
+type ID string
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*id = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*id = ID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = ID(n.String())
+	return nil
+}
+
+// LegacyBackend uses the open api. Requests are made with fresh Config and Client holders, since they keep response data.
+type LegacyBackend struct {
+	BaseURL    string
+	httpClient *http.Client
+}
+
+// NewLegacyBackend creates a backend for the open api
+func NewLegacyBackend() *LegacyBackend {
+	return &LegacyBackend{BaseURL: baseURL, httpClient: &http.Client{Timeout: requestTimeout}}
+}
+
+func (lb *LegacyBackend) api() openAPI {
+	return openAPI{baseURL: lb.BaseURL, httpClient: lb.httpClient}
+}
+
+func (lb *LegacyBackend) NeedsAuthCode() bool {
+	return true
+}
+
+func (lb *LegacyBackend) Login(ctx context.Context, authCode string, password string, username string) (string, string, int64, int64, error) {
+	config := Config{api: lb.api()}
+	return config.NewClient(ctx, authCode, password, username)
+}
+
+func (lb *LegacyBackend) RefreshToken(ctx context.Context, refreshToken string) (string, string, int64, int64, error) {
+	config := Config{api: lb.api()}
+	return config.RefreshToken(ctx, refreshToken)
+}
+
+func (lb *LegacyBackend) UpdateLists(ctx context.Context, accessToken string, hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}) ([]interface{}, []interface{}, []interface{}, []interface{}, error) {
+	client := Client{api: lb.api()}
+	return client.UpdateLists(ctx, accessToken, hc, rc, dc, idc)
+}
+
+// Ping gets the home list, the first call of UpdateLists
+func (lb *LegacyBackend) Ping(ctx context.Context, accessToken string) error {
+	if accessToken == "" {
+		return ErrUnauthorized
+	}
+	client := Client{api: lb.api()}
+	_, err := client.GetHomeList(ctx, accessToken)
+	return err
+}
+
+func (lb *LegacyBackend) ReadDevice(ctx context.Context, accessToken string, homeID string, roomID string, deviceID string) (Device, error) {
+	devices, err := lb.ReadDevices(ctx, accessToken, homeID, roomID)
+	if err != nil {
+		return Device{}, err
+	}
+	return findDevice(devices, deviceID)
+}
+
+func (lb *LegacyBackend) ReadDevices(ctx context.Context, accessToken string, homeID string, roomID string) ([]Device, error) {
+	client := Client{api: lb.api()}
+	var devices []Device
+	if roomID != "" {
+		if _, err := client.GetDeviceList(ctx, accessToken, ID(roomID)); err != nil {
+			return nil, err
+		}
+		devices = client.Data.Devices
+	} else {
+		if _, err := client.GetIndependentDevices(ctx, accessToken, ID(homeID)); err != nil {
+			return nil, err
+		}
+		devices = client.Data.IndependentDevices
+	}
+	for i := range devices {
+		devices[i].HomeID, devices[i].RoomID = ID(homeID), ID(roomID)
+		devices[i].DeviceType = legacyDeviceType(devices[i])
+	}
+	return devices, nil
+}
+
+// findDevice returns the device with deviceID, or model.ErrDeviceNotFound
+func findDevice(devices []Device, deviceID string) (Device, error) {
+	for _, device := range devices {
+		if string(device.DeviceID) == deviceID {
+			return device, nil
+		}
+	}
+	return Device{}, fmt.Errorf("%w: %s", model.ErrDeviceNotFound, deviceID)
+}
+
+func (lb *LegacyBackend) DeviceControl(ctx context.Context, accessToken string, deviceId string, newTemp string) bool {
+	config := Config{api: lb.api()}
+	return config.DeviceControl(ctx, accessToken, deviceId, newTemp)
+}
+
+func (lb *LegacyBackend) SwitchControl(ctx context.Context, accessToken string, deviceId string, on bool) bool {
+	config := Config{api: lb.api()}
+	return config.SwitchControl(ctx, accessToken, deviceId, on)
+}
+
+// SupportsPowerLevel is false, the open api can't set power level
+func (lb *LegacyBackend) SupportsPowerLevel() bool {
+	return false
+}
+
+// SetPowerLevel is not supported by the open api
+func (lb *LegacyBackend) SetPowerLevel(ctx context.Context, accessToken string, deviceId string, level int) bool {
+	log.Warn("<millapi> Power level can't be set through the open api, switch to customer api")
+	return false
+}
+
+// SupportsDecimalSetpoint is false, the open api only takes whole degrees
+func (lb *LegacyBackend) SupportsDecimalSetpoint() bool {
+	return false
+}
+
+// SupportsModeControl is false, the open api can't turn heaters off
+func (lb *LegacyBackend) SupportsModeControl() bool {
+	return false
+}
+
+// HeaterModeControl is not supported by the open api
+func (lb *LegacyBackend) HeaterModeControl(ctx context.Context, accessToken string, deviceId string, on bool) bool {
+	log.Warn("<millapi> Heaters can't be turned off through the open api, use local control or switch to customer api")
+	return false
+}
+
+// DecodeLists turns lists loaded from state.json, where items are maps, back into Home, Room and Device values,
+// so lists kept from an earlier run can be used like fresh lists. Items that can't be decoded are dropped.
+func DecodeLists(hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}) ([]interface{}, []interface{}, []interface{}, []interface{}) {
+	return decodeList(hc, func() interface{} { return &Home{} }),
+		decodeList(rc, func() interface{} { return &Room{} }),
+		decodeList(dc, func() interface{} { return &Device{} }),
+		decodeList(idc, func() interface{} { return &Device{} })
+}
+
+func decodeList(list []interface{}, newItem func() interface{}) []interface{} {
+	var decoded []interface{}
+	for _, item := range list {
+		if _, ok := item.(map[string]interface{}); !ok {
+			decoded = append(decoded, item)
+			continue
+		}
+		body, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		typed := newItem()
+		if err := json.Unmarshal(body, typed); err != nil {
+			log.Warn("Can't decode stored list item. Error: ", err)
+			continue
+		}
+		decoded = append(decoded, reflect.ValueOf(typed).Elem().Interface())
+	}
+	return decoded
+}
@@ -2,11 +2,15 @@ package mill
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/thingsplex/mill/model"
 
@@ -16,33 +20,79 @@ import (
 )
 
 const (
-	// DefaultBaseURL is mill api url
+	// baseURL is mill api url
 	baseURL = "https://api.millheat.com/"
-	// applyAccessTokenURL is mill api to get access_token and refresh_token
-	applyAccessTokenURL = baseURL + "share/applyAccessToken"
-	// authURL is mill api to get authorization_code
-	authURL = baseURL + "share/applyAuthCode"
-	// refreshURL is mill api to update access_token and refresh_token
-	refreshURL = baseURL + "share/refreshtoken?refreshtoken="
-
-	// deviceControlForOpenApiURL is mill api to controll individual devices
-	deviceControlURL = baseURL + "uds/deviceControlForOpenApi"
-	// getIndependentDevicesURL is mill api to get list of devices in unassigned room
-	getIndependentDevicesURL = baseURL + "uds/getIndependentDevices"
-	// selectDevicebyRoomURL is mill api to search device list by room
-	selectDevicebyRoomURL = baseURL + "uds/selectDevicebyRoom"
-	// selectHomeListURL is mill api to search housing list
-	selectHomeListURL = baseURL + "uds/selectHomeList"
-	// selectRoombyHomeURL is mill api to search room list by home
-	selectRoombyHomeURL = baseURL + "uds/selectRoombyHome"
+	// applyAccessTokenPath is mill api to get access_token and refresh_token
+	applyAccessTokenPath = "share/applyAccessToken"
+	// refreshPath is mill api to update access_token and refresh_token
+	refreshPath = "share/refreshtoken?refreshtoken="
+
+	// deviceControlPath is mill api to controll individual devices
+	deviceControlPath = "uds/deviceControlForOpenApi"
+	// getIndependentDevicesPath is mill api to get list of devices in unassigned room
+	getIndependentDevicesPath = "uds/getIndependentDevices"
+	// selectDevicebyRoomPath is mill api to search device list by room
+	selectDevicebyRoomPath = "uds/selectDevicebyRoom"
+	// selectHomeListPath is mill api to search housing list
+	selectHomeListPath = "uds/selectHomeList"
+	// selectRoombyHomePath is mill api to search room list by home
+	selectRoombyHomePath = "uds/selectRoombyHome"
+
+	// requestTimeout limits every call to Mill, so an unresponsive api can't block the adapter
+	requestTimeout = 30 * time.Second
 )
 
+// tokenErrorCodes are error codes the open api answers with http 200 when the access token is invalid or expired.
+// Mill publishes no list of error codes, these are the token errors handled by the pymill client.
+var tokenErrorCodes = map[int]bool{3514: true, 3515: true}
+
+// apiError turns an error code in a response into an error. Only token errors need a new login, other codes,
+// like too many requests, are errors of the api.
+func apiError(code int, message string) error {
+	if tokenErrorCodes[code] {
+		return fmt.Errorf("%w: error code %d, %s", ErrUnauthorized, code, message)
+	}
+	return fmt.Errorf("Mill error code %d, %s", code, message)
+}
+
+// defaultHTTPClient is used for the open api and the partner proxy when no other client is set
+var defaultHTTPClient = &http.Client{Timeout: requestTimeout}
+
+// openAPI sends requests to the open api. Zero value uses baseURL and defaultHTTPClient.
+type openAPI struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// post sends a request with the given headers to path and decodes the response into holder
+func (api openAPI) post(ctx context.Context, path string, headers map[string]string, holder interface{}) error {
+	base, client := api.baseURL, api.httpClient
+	if base == "" {
+		base = baseURL
+	}
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "*/*")
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	resp, err := client.Do(req)
+	return processHTTPResponse(resp, err, holder)
+}
+
 // Config is used to specify credential to Mill API
 // AccessKey : Access Key from api registration at http://api.millheat.com. Key is sent to mail.
 // SecretToken: Secret Token from api registration at http://api.millheat.com. Token is sent to mail.
 // Username: Your mill app account username
 // Password: Your mill app account password
 type Config struct {
+	api openAPI
+
 	ErrorCode  int    `json:"errorCode"`
 	Message    string `json:"message"`
 	StatusCode int    `json:"statusCode"`
@@ -62,7 +112,10 @@ type Config struct {
 
 // Client to make request to Mill API
 type Client struct {
-	httpResponse *http.Response
+	api openAPI
+
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
 
 	Data struct {
 		Homes              []Home   `json:"homeList"`
@@ -72,13 +125,13 @@ type Client struct {
 	} `json:"data"`
 }
 
-// Device is a mill heater
+// Device is a mill heater, socket or sensor
 type Device struct {
 	MaxTemperature       int     `json:"maxTemperature"`
 	MaxTemperatureMsg    string  `json:"maxTemperatureMsg"`
 	ChangeTemperature    int     `json:"changeTemperature"`
 	CanChangeTemp        int     `json:"canChangeTemp"`
-	DeviceID             int64   `json:"deviceId"`
+	DeviceID             ID      `json:"deviceId"`
 	DeviceName           string  `json:"deviceName"`
 	ChangeTemperatureMsg string  `json:"changeTemperatureMsg"`
 	Mac                  string  `json:"mac"`
@@ -87,7 +140,24 @@ type Device struct {
 	SubDomainID          int     `json:"subDomainId"`
 	ControlType          int     `json:"controlType"`
 	CurrentTemp          float32 `json:"currentTemp"`
-	SetpointTemp         int64   `json:"holidayTemp"`
+	SetpointTemp         float32 `json:"holidayTemp"`
+
+	HomeID   ID     `json:"homeId"`
+	HomeName string `json:"homeName"`
+	RoomID   ID     `json:"roomId"`
+	RoomName string `json:"roomName"`
+	// DeviceType is detected by the adapter, one of model.DeviceType constants
+	DeviceType string `json:"adapterDeviceType"`
+	// ProductType is the device type reported by the customer api, e.g. PanelHeaterGen3. Open api devices are
+	// identified by SubDomainID instead.
+	ProductType     string  `json:"productType"`
+	ModelName       string  `json:"modelName"`
+	FirmwareVersion string  `json:"firmwareVersion"`
+	PowerStatus     int     `json:"powerStatus"`
+	PowerLevel      int     `json:"powerLevel"`
+	Humidity        float32 `json:"humidity"`
+	Co2             float32 `json:"co2"`
+	Tvoc            float32 `json:"tvoc"`
 }
 
 type Home struct {
@@ -102,7 +172,7 @@ type Home struct {
 	CurrentMode      int         `json:"currentMode"`
 	HolidayEndTime   int         `json:"holidayEndTime"`
 	HomeType         interface{} `json:"homeType"`
-	HomeID           int64       `json:"homeId"`
+	HomeID           ID          `json:"homeId"`
 	ProgramID        int64       `json:"programId"`
 }
 
@@ -117,7 +187,7 @@ type Room struct {
 	AwayTemp             int           `json:"awayTemp"`
 	AvgTemp              int           `json:"avgTemp"`
 	ChangeTemperatureMsg string        `json:"changeTemperatureMsg"`
-	RoomID               int64         `json:"roomId"`
+	RoomID               ID            `json:"roomId"`
 	RoomName             string        `json:"roomName"`
 	CurrentMode          int           `json:"currentMode"`
 	HeatStatus           int           `json:"heatStatus"`
@@ -130,43 +200,23 @@ type Room struct {
 }
 
 // NewClient create a handle authentication to Mill API
-func (config *Config) NewClient(authCode string, password string, username string) (string, string, int64, int64) {
+func (config *Config) NewClient(ctx context.Context, authCode string, password string, username string) (string, string, int64, int64, error) {
 	urlpassword := url.QueryEscape(password)
 	urlusername := url.QueryEscape(username)
-	url := applyAccessTokenURL + "?password=" + urlpassword + "&username=" + urlusername
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't post accessToken request, error: ", err))
+	path := applyAccessTokenPath + "?password=" + urlpassword + "&username=" + urlusername
+	if err := config.api.post(ctx, path, map[string]string{"Authorization_code": authCode}, config); err != nil {
+		return "", "", 0, 0, err
 	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Authorization_code", authCode)
-
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, config)
 
 	accessToken := config.Data.AccessToken
 	refreshToken := config.Data.RefreshToken
 	expireTime := config.Data.ExpireTime
 	refreshExpireTime := config.Data.RefreshExpireTime
-	if err != nil {
-		return "", "", 0, 0
-	}
-	defer resp.Body.Close()
-	return accessToken, refreshToken, expireTime, refreshExpireTime
+	return accessToken, refreshToken, expireTime, refreshExpireTime, nil
 }
 
-func (config *Config) RefreshToken(refreshToken string) (string, string, int64, int64, error) {
-	url := fmt.Sprintf("%s%s", refreshURL, refreshToken)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't post refreshToken request, error: ", err))
-	}
-	req.Header.Set("Accept", "*/*")
-
-	resp, err := http.DefaultClient.Do(req)
-	if processHTTPResponse(resp, err, config) != nil {
+func (config *Config) RefreshToken(ctx context.Context, refreshToken string) (string, string, int64, int64, error) {
+	if err := config.api.post(ctx, refreshPath+refreshToken, nil, config); err != nil {
 		return config.Data.AccessToken, config.Data.RefreshToken, config.Data.ExpireTime, config.Data.RefreshExpireTime, err
 	}
 
@@ -174,130 +224,107 @@ func (config *Config) RefreshToken(refreshToken string) (string, string, int64,
 	newRefreshToken := config.Data.RefreshToken
 	expireTime := config.Data.ExpireTime
 	refreshExpireTime := config.Data.RefreshExpireTime
-
-	defer resp.Body.Close()
 	return accessToken, newRefreshToken, expireTime, refreshExpireTime, nil
 }
 
-func (c *Client) GetAllDevices(accessToken string) ([]Device, []Room, []Home, []Device, error) {
-	homes, err := c.GetHomeList(accessToken)
+// GetAllDevices reads all homes, rooms and devices on the account. It fails if any list can't be read, since
+// devices missing from a partial list would be taken as removed from the account.
+func (c *Client) GetAllDevices(ctx context.Context, accessToken string) ([]Device, []Room, []Home, []Device, error) {
+	homes, err := c.GetHomeList(ctx, accessToken)
 	var allDevices []Device
 	var allRooms []Room
 	var allHomes []Home
 	var allIndependentDevices []Device
 	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get home list, error: ", err))
+		return nil, nil, nil, nil, err
 	}
 	for home := range homes.Data.Homes {
 		allHomes = append(allHomes, homes.Data.Homes[home])
-		rooms, err := c.GetRoomList(accessToken, homes.Data.Homes[home].HomeID)
+		rooms, err := c.GetRoomList(ctx, accessToken, homes.Data.Homes[home].HomeID)
 		if err != nil {
-			// handle err
-			log.Error(fmt.Errorf("Can't get room list, error: ", err))
+			return nil, nil, nil, nil, fmt.Errorf("can't get room list of home %s: %w", homes.Data.Homes[home].HomeID, err)
 		}
 		for room := range rooms.Data.Rooms {
 			allRooms = append(allRooms, rooms.Data.Rooms[room])
-			devices, err := c.GetDeviceList(accessToken, rooms.Data.Rooms[room].RoomID)
-			for device := range devices.Data.Devices {
-				allDevices = append(allDevices, devices.Data.Devices[device])
-			}
+			devices, err := c.GetDeviceList(ctx, accessToken, rooms.Data.Rooms[room].RoomID)
 			if err != nil {
-				// handle err
-				log.Error(fmt.Errorf("Can't get device list, error: ", err))
+				return nil, nil, nil, nil, fmt.Errorf("can't get device list of room %s: %w", rooms.Data.Rooms[room].RoomID, err)
+			}
+			for device := range devices.Data.Devices {
+				roomDevice := devices.Data.Devices[device]
+				roomDevice.RoomID = rooms.Data.Rooms[room].RoomID
+				roomDevice.RoomName = rooms.Data.Rooms[room].RoomName
+				roomDevice.HomeID = homes.Data.Homes[home].HomeID
+				roomDevice.HomeName = homes.Data.Homes[home].HomeName
+				allDevices = append(allDevices, roomDevice)
 			}
 		}
 		// Get all independent devices
-		independentDevices, err := c.GetIndependentDevices(accessToken, homes.Data.Homes[home].HomeID)
+		independentDevices, err := c.GetIndependentDevices(ctx, accessToken, homes.Data.Homes[home].HomeID)
 		if err != nil {
-			// handle err
-			log.Error(fmt.Errorf("Can't get independent device list, error: ", err))
+			return nil, nil, nil, nil, fmt.Errorf("can't get independent device list of home %s: %w", homes.Data.Homes[home].HomeID, err)
 		}
 		for device := range independentDevices.Data.IndependentDevices {
-			allDevices = append(allDevices, independentDevices.Data.IndependentDevices[device])
-			allIndependentDevices = append(allIndependentDevices, independentDevices.Data.IndependentDevices[device])
+			independentDevice := independentDevices.Data.IndependentDevices[device]
+			independentDevice.HomeID = homes.Data.Homes[home].HomeID
+			independentDevice.HomeName = homes.Data.Homes[home].HomeName
+			allDevices = append(allDevices, independentDevice)
+			allIndependentDevices = append(allIndependentDevices, independentDevice)
 		}
 	}
 	return allDevices, allRooms, allHomes, allIndependentDevices, nil
 }
 
 // GetHomeList sends curl request to get list of homes connected to user
-func (c *Client) GetHomeList(accessToken string) (*Client, error) {
-	req, err := http.NewRequest("POST", selectHomeListURL, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get home list, error: ", err))
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-
-	return c, nil
+func (c *Client) GetHomeList(ctx context.Context, accessToken string) (*Client, error) {
+	return c, c.request(ctx, selectHomeListPath, accessToken)
 }
 
 // GetRoomList sends curl request to get list of rooms by home
-func (c *Client) GetRoomList(accessToken string, homeID int64) (*Client, error) {
-	url := fmt.Sprintf("%s%s%d", selectRoombyHomeURL, "?homeId=", homeID)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get room list, error: ", err))
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-	return c, nil
+func (c *Client) GetRoomList(ctx context.Context, accessToken string, homeID ID) (*Client, error) {
+	return c, c.request(ctx, fmt.Sprintf("%s%s%s", selectRoombyHomePath, "?homeId=", homeID), accessToken)
 }
 
 // GetDeviceList sends curl request to get list of devices by room
-func (c *Client) GetDeviceList(accessToken string, roomID int64) (*Client, error) {
-	url := fmt.Sprintf("%s%s%d", selectDevicebyRoomURL, "?roomId=", roomID)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		log.Error(fmt.Errorf("Can't get device list, error: ", err))
-		// handle err
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
+func (c *Client) GetDeviceList(ctx context.Context, accessToken string, roomID ID) (*Client, error) {
+	return c, c.request(ctx, fmt.Sprintf("%s%s%s", selectDevicebyRoomPath, "?roomId=", roomID), accessToken)
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-	return c, nil
+func (c *Client) GetIndependentDevices(ctx context.Context, accessToken string, homeId ID) (*Client, error) {
+	return c, c.request(ctx, fmt.Sprintf("%s%s%s", getIndependentDevicesPath, "?homeId=", homeId), accessToken)
 }
 
-func (c *Client) GetIndependentDevices(accessToken string, homeId int64) (*Client, error) {
-	url := fmt.Sprintf("%s%s%d", getIndependentDevicesURL, "?homeId=", homeId)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get independent device list, error: ", err))
+// request sends a list request and checks the error code in the response. Open api answers errors with http 200.
+func (c *Client) request(ctx context.Context, path string, accessToken string) error {
+	c.ErrorCode, c.Message = 0, ""
+	if err := c.api.post(ctx, path, map[string]string{"Access_token": accessToken}, c); err != nil {
+		return err
 	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-	return c, nil
+	if c.ErrorCode != 0 {
+		return apiError(c.ErrorCode, c.Message)
+	}
+	return nil
 }
 
-func (cf *Config) DeviceControl(accessToken string, deviceId string, newTemp string) bool {
-	url := fmt.Sprintf("%s%s%s%s%s%s", deviceControlURL, "?deviceId=", deviceId, "&holdTemp=", newTemp, "&operation=1&status=1")
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't controll device, error: ", err))
+// SwitchControl turns device on or off. Used for sockets, where temperature can't be set.
+func (cf *Config) SwitchControl(ctx context.Context, accessToken string, deviceId string, on bool) bool {
+	status := 0
+	if on {
+		status = 1
 	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
+	path := fmt.Sprintf("%s%s%s%s%d", deviceControlPath, "?deviceId=", deviceId, "&operation=0&status=", status)
+	if err := cf.api.post(ctx, path, map[string]string{"Access_token": accessToken}, cf); err != nil {
+		log.Debug("Error in SwitchControl: ", err)
+		return false
+	}
+	return cf.ErrorCode == 0
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, cf)
-	if err != nil {
+func (cf *Config) DeviceControl(ctx context.Context, accessToken string, deviceId string, newTemp string) bool {
+	path := fmt.Sprintf("%s%s%s%s%s%s", deviceControlPath, "?deviceId=", deviceId, "&holdTemp=", newTemp, "&operation=1&status=1")
+	if err := cf.api.post(ctx, path, map[string]string{"Access_token": accessToken}, cf); err != nil {
 		log.Debug("Error in DeviceControl: ", err)
+		return false
 	}
 	if cf.ErrorCode == 0 {
 		return true
@@ -305,7 +332,7 @@ func (cf *Config) DeviceControl(accessToken string, deviceId string, newTemp str
 	return false
 }
 
-func (cf *Config) GetAuthCode(oldMsg *fimpgo.Message) (string, string) {
+func (cf *Config) GetAuthCode(ctx context.Context, oldMsg *fimpgo.Message) (string, string) {
 	cfs := model.Configs{}
 	val, err := oldMsg.Payload.GetStrMapValue()
 	if err != nil {
@@ -342,22 +369,40 @@ func (cf *Config) GetAuthCode(oldMsg *fimpgo.Message) (string, string) {
 		url = "https://partners.futurehome.io/api/control/edge/proxy/custom/auth-code"
 	}
 
-	req, err := http.NewRequest("POST", url, body)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		// handle err
 		log.Debug(fmt.Errorf("Issue when making request to partner-api"))
+		return "", ""
 	}
 	req.Header.Set("Authorization", os.ExpandEnv(fmt.Sprintf("%s%s", "Bearer ", cfs.HubToken)))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Postman-Token", "65cb80d3-cbd2-4c8d-954a-bb3253b306e5")
 	req.Header.Set("Cache-Control", "no-cache")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := defaultHTTPClient.Do(req)
 	processHTTPResponse(resp, err, cf)
 
 	authorizationCode := cf.Data.AuthorizationCode
 	return authorizationCode, cfs.HubToken
 }
 
+// unknownSubDomains keeps subDomainIds missing from the catalog that have been logged
+var unknownSubDomains sync.Map
+
+// legacyDeviceType returns the type of an open api device. What subDomainId values mean is not confirmed by Mill,
+// so devices are heaters, which keeps setpoint control if the device really is a heater. Only Sense sensors measure
+// CO2 and TVOC, so devices reporting them are sensors.
+func legacyDeviceType(device Device) string {
+	if device.Co2 > 0 || device.Tvoc > 0 {
+		return model.DeviceTypeSensor
+	}
+	_, ok := model.LookupCatalog(device.SubDomainID)
+	if _, logged := unknownSubDomains.LoadOrStore(device.SubDomainID, true); !ok && !logged {
+		log.Info("<millapi> Device ", device.DeviceName, " has subDomainId ", device.SubDomainID, ", which is not in the catalog. It is handled as a heater.")
+	}
+	return model.DeviceTypeHeater
+}
+
 // Unmarshall received data into holder struct
 func processHTTPResponse(resp *http.Response, err error, holder interface{}) error {
 	if err != nil {
@@ -366,6 +411,10 @@ func processHTTPResponse(resp *http.Response, err error, holder interface{}) err
 	}
 	defer resp.Body.Close()
 	// check http return code
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		log.Error("Bad HTTP return code ", resp.StatusCode)
+		return fmt.Errorf("%w: HTTP return code %d", ErrUnauthorized, resp.StatusCode)
+	}
 	if resp.StatusCode != 200 {
 		//bytes, _ := ioutil.ReadAll(resp.Body)
 		log.Error("Bad HTTP return code ", resp.StatusCode)
@@ -373,17 +422,20 @@ func processHTTPResponse(resp *http.Response, err error, holder interface{}) err
 	}
 
 	// Unmarshall response into given struct
-	if err = json.NewDecoder(resp.Body).Decode(holder); err != nil {
+	if err = json.NewDecoder(resp.Body).Decode(holder); err != nil && err != io.EOF {
 		return err
 	}
 	return nil
 }
 
-func (c *Client) UpdateLists(accessToken string, hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}) (homelist []interface{}, roomlist []interface{}, devicelist []interface{}, independentdevicelist []interface{}) {
-	allDevices, allRooms, allHomes, allIndependentDevices, err := c.GetAllDevices(accessToken)
+func (c *Client) UpdateLists(ctx context.Context, accessToken string, hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}) (homelist []interface{}, roomlist []interface{}, devicelist []interface{}, independentdevicelist []interface{}, err error) {
+	if accessToken == "" {
+		return hc, rc, dc, idc, ErrUnauthorized
+	}
+	allDevices, allRooms, allHomes, allIndependentDevices, err := c.GetAllDevices(ctx, accessToken)
 	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't update lists, error: ", err))
+		log.Error(fmt.Errorf("Can't update lists, error: %v", err))
+		return hc, rc, dc, idc, err
 	}
 	for home := range allHomes {
 		hc = append(hc, allHomes[home])
@@ -392,10 +444,12 @@ func (c *Client) UpdateLists(accessToken string, hc []interface{}, rc []interfac
 		rc = append(rc, allRooms[room])
 	}
 	for device := range allDevices {
+		allDevices[device].DeviceType = legacyDeviceType(allDevices[device])
 		dc = append(dc, allDevices[device])
 	}
 	for device := range allIndependentDevices {
+		allIndependentDevices[device].DeviceType = legacyDeviceType(allIndependentDevices[device])
 		idc = append(idc, allIndependentDevices[device])
 	}
-	return hc, rc, dc, idc
+	return hc, rc, dc, idc, nil
 }
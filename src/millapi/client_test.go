@@ -0,0 +1,220 @@
+package mill
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/thingsplex/mill/internal/standin"
+	"github.com/thingsplex/mill/model"
+)
+
+// legacyAccount is an open api account with one home, a heater in a room and an independent socket
+var legacyAccount = map[string]standin.Response{
+	"POST /uds/selectHomeList":        standin.OK(`{"errorCode":0,"data":{"homeList":[{"homeId":201,"homeName":"Home"}]}}`),
+	"POST /uds/selectRoombyHome":      standin.OK(`{"errorCode":0,"data":{"roomList":[{"roomId":301,"roomName":"Living room"}]}}`),
+	"POST /uds/selectDevicebyRoom":    standin.OK(`{"errorCode":0,"data":{"deviceList":[{"deviceId":401,"deviceName":"Heater","subDomainId":5332,"currentTemp":21.5,"holidayTemp":22}]}}`),
+	"POST /uds/getIndependentDevices": standin.OK(`{"errorCode":0,"data":{"deviceInfoList":[{"deviceId":402,"deviceName":"Socket","subDomainId":5316}]}}`),
+}
+
+func newLegacyStandIn(changes map[string]standin.Response) (*standin.Server, *LegacyBackend) {
+	responses := make(map[string]standin.Response)
+	for route, resp := range legacyAccount {
+		responses[route] = resp
+	}
+	for route, resp := range changes {
+		responses[route] = resp
+	}
+	si := standin.New(responses)
+	backend := NewLegacyBackend()
+	backend.BaseURL = si.URL + "/"
+	return si, backend
+}
+
+func TestLegacyUpdateLists(t *testing.T) {
+	si, backend := newLegacyStandIn(nil)
+	defer si.Close()
+
+	homes, rooms, devices, independent, err := backend.UpdateLists(context.Background(), "access", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(homes) != 1 || len(rooms) != 1 || len(devices) != 2 || len(independent) != 1 {
+		t.Fatalf("got %d homes, %d rooms, %d devices and %d independent devices", len(homes), len(rooms), len(devices), len(independent))
+	}
+	heater := devices[0].(Device)
+	if heater.DeviceID != "401" || heater.HomeID != "201" || heater.RoomID != "301" || heater.RoomName != "Living room" || heater.DeviceType != model.DeviceTypeHeater || heater.SetpointTemp != 22 {
+		t.Errorf("unexpected heater %+v", heater)
+	}
+	// subDomainIds are not confirmed by Mill, so the socket is included as a heater
+	socket := independent[0].(Device)
+	if socket.DeviceID != "402" || socket.HomeID != "201" || socket.RoomID != "" || socket.DeviceType != model.DeviceTypeHeater {
+		t.Errorf("unexpected socket %+v", socket)
+	}
+	if got := si.Received("POST /uds/selectDevicebyRoom"); len(got) != 1 || got[0].Query != "roomId=301" || got[0].Header.Get("Access_token") != "access" {
+		t.Errorf("unexpected device list requests %+v", got)
+	}
+}
+
+func TestLegacyUnknownDeviceHasThermostat(t *testing.T) {
+	si, backend := newLegacyStandIn(map[string]standin.Response{
+		"POST /uds/selectDevicebyRoom": standin.OK(`{"errorCode":0,"data":{"deviceList":[{"deviceId":401,"deviceName":"Heater","subDomainId":99999,"canChangeTemp":1}]}}`),
+	})
+	defer si.Close()
+
+	_, _, devices, _, err := backend.UpdateLists(context.Background(), "access", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := model.NetworkService{}
+	report := ns.SendInclusionReport(0, devices)
+	if thermostat := findService(report, "thermostat"); thermostat == nil || !hasInterface(thermostat, "cmd.setpoint.set") {
+		t.Errorf("device with unknown subDomainId got services %+v, expected a thermostat with setpoint control", report.Services)
+	}
+}
+
+func TestLegacySenseIsSensor(t *testing.T) {
+	si, backend := newLegacyStandIn(map[string]standin.Response{
+		"POST /uds/selectDevicebyRoom": standin.OK(`{"errorCode":0,"data":{"deviceList":[{"deviceId":401,"deviceName":"Sense","subDomainId":99999,"canChangeTemp":1,"currentTemp":21.5,"co2":612,"tvoc":120}]}}`),
+	})
+	defer si.Close()
+
+	_, _, devices, _, err := backend.UpdateLists(context.Background(), "access", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sense := devices[0].(Device); sense.DeviceType != model.DeviceTypeSensor {
+		t.Fatalf("device measuring CO2 has type %q, expected a sensor", sense.DeviceType)
+	}
+	ns := model.NetworkService{}
+	report := ns.SendInclusionReport(0, devices[:1])
+	if findService(report, "thermostat") != nil {
+		t.Errorf("Sense got a thermostat")
+	}
+	for _, name := range []string{"sensor_temp", "sensor_co2", "sensor_voc"} {
+		if findService(report, name) == nil {
+			t.Errorf("Sense has no %s, got services %+v", name, report.Services)
+		}
+	}
+}
+
+func TestLegacyModeControlNeedsLocalAddress(t *testing.T) {
+	devices := []interface{}{Device{DeviceID: "401", DeviceType: model.DeviceTypeHeater, CanChangeTemp: 1}}
+	for name, test := range map[string]struct {
+		localDevices map[string]string
+		modes        []string
+	}{
+		"cloud only":    {modes: []string{"heat"}},
+		"local control": {localDevices: map[string]string{"401": "192.168.1.20"}, modes: []string{"off", "heat"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ns := model.NetworkService{ModeControl: NewLegacyBackend().SupportsModeControl(), LocalDevices: test.localDevices}
+			thermostat := findService(ns.SendInclusionReport(0, devices), "thermostat")
+			if thermostat == nil {
+				t.Fatal("heater has no thermostat")
+			}
+			if modes := thermostat.Props["sup_modes"]; !reflect.DeepEqual(modes, test.modes) {
+				t.Errorf("thermostat supports modes %v, expected %v", modes, test.modes)
+			}
+			if hasInterface(thermostat, "cmd.mode.set") != (len(test.modes) > 1) {
+				t.Errorf("thermostat with modes %v has interfaces %+v", test.modes, thermostat.Interfaces)
+			}
+		})
+	}
+}
+
+func TestLegacyUpdateListsKeepsListsOnPartialFetch(t *testing.T) {
+	si, backend := newLegacyStandIn(map[string]standin.Response{
+		"POST /uds/getIndependentDevices": {Status: http.StatusInternalServerError},
+	})
+	defer si.Close()
+
+	lastHomes, lastDevices := []interface{}{Home{HomeID: "201"}}, []interface{}{Device{DeviceID: "401"}, Device{DeviceID: "402"}}
+	homes, rooms, devices, independent, err := backend.UpdateLists(context.Background(), "access", lastHomes, nil, lastDevices, nil)
+	if err == nil {
+		t.Fatal("partial fetch succeeded")
+	}
+	if !reflect.DeepEqual(homes, lastHomes) || rooms != nil || !reflect.DeepEqual(devices, lastDevices) || independent != nil {
+		t.Errorf("lists were changed by a partial fetch")
+	}
+}
+
+func TestLegacyErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		resp         standin.Response
+		unauthorized bool
+		text         string
+	}{
+		"invalid token": {resp: standin.OK(`{"errorCode":3514,"message":"token invalid"}`), unauthorized: true, text: "error code 3514"},
+		"expired token": {resp: standin.OK(`{"errorCode":3515,"message":"token expired"}`), unauthorized: true, text: "error code 3515"},
+		"other code":    {resp: standin.OK(`{"errorCode":1001,"message":"too many requests"}`), text: "Mill error code 1001, too many requests"},
+		"http 401":      {resp: standin.Response{Status: http.StatusUnauthorized}, unauthorized: true, text: "HTTP return code 401"},
+		"http 500":      {resp: standin.Response{Status: http.StatusInternalServerError}, text: "Bad HTTP return code 500"},
+		"not json":      {resp: standin.OK(`<html>`)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			si, backend := newLegacyStandIn(map[string]standin.Response{"POST /uds/selectHomeList": test.resp})
+			defer si.Close()
+			err := backend.Ping(context.Background(), "access")
+			if err == nil {
+				t.Fatal("error was not returned")
+			}
+			if errors.Is(err, ErrUnauthorized) != test.unauthorized {
+				t.Errorf("error %q, unauthorized %v expected", err, test.unauthorized)
+			}
+			if !strings.Contains(err.Error(), test.text) {
+				t.Errorf("error %q does not contain %q", err, test.text)
+			}
+		})
+	}
+}
+
+func TestLegacyNeedsAccessToken(t *testing.T) {
+	si, backend := newLegacyStandIn(nil)
+	defer si.Close()
+
+	if _, _, _, _, err := backend.UpdateLists(context.Background(), "", nil, nil, nil, nil); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("lists were fetched without access token, error %v", err)
+	}
+	if got := si.Received("POST /uds/selectHomeList"); len(got) != 0 {
+		t.Errorf("Mill was called without access token")
+	}
+}
+
+func TestLegacyDeviceControl(t *testing.T) {
+	for name, test := range map[string]struct {
+		resp     standin.Response
+		accepted bool
+	}{
+		"accepted":   {resp: standin.OK(`{"errorCode":0}`), accepted: true},
+		"error code": {resp: standin.OK(`{"errorCode":3515,"message":"token expired"}`)},
+		"http 500":   {resp: standin.Response{Status: http.StatusInternalServerError}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			si, backend := newLegacyStandIn(map[string]standin.Response{"POST /uds/deviceControlForOpenApi": test.resp})
+			defer si.Close()
+			if accepted := backend.DeviceControl(context.Background(), "access", "401", "21"); accepted != test.accepted {
+				t.Errorf("DeviceControl returned %v", accepted)
+			}
+			got := si.Received("POST /uds/deviceControlForOpenApi")
+			if len(got) != 1 || got[0].Query != "deviceId=401&holdTemp=21&operation=1&status=1" {
+				t.Errorf("unexpected control requests %+v", got)
+			}
+		})
+	}
+}
+
+func TestLegacySwitchControl(t *testing.T) {
+	si, backend := newLegacyStandIn(map[string]standin.Response{"POST /uds/deviceControlForOpenApi": standin.OK(`{"errorCode":0}`)})
+	defer si.Close()
+
+	if !backend.SwitchControl(context.Background(), "access", "402", false) {
+		t.Fatal("SwitchControl failed")
+	}
+	if got := si.Received("POST /uds/deviceControlForOpenApi"); len(got) != 1 || got[0].Query != "deviceId=402&operation=0&status=0" {
+		t.Errorf("unexpected control requests %+v", got)
+	}
+}
@@ -0,0 +1,400 @@
+package mill
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/mill/model"
+)
+
+const (
+	// customerBaseURL is mill customer api url
+	customerBaseURL = "https://api.millnorwaycloud.com/"
+	// signInPath is customer api to log in with email and password
+	signInPath = "customer/auth/sign-in"
+	// customerRefreshPath is customer api to update idToken and refreshToken
+	customerRefreshPath = "customer/auth/refresh"
+	// housesPath is customer api to get houses owned by the user
+	housesPath = "houses"
+	// houseDevicesPath is customer api to get rooms with devices by house
+	houseDevicesPath = "houses/%s/devices"
+	// houseIndependentDevicesPath is customer api to get devices not assigned to a room
+	houseIndependentDevicesPath = "houses/%s/devices/independent"
+	// deviceSettingsPath is customer api to control individual devices
+	deviceSettingsPath = "devices/%s/settings"
+
+	// refreshTokenLifetime is used when refresh token does not carry its own expiry
+	refreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+// CustomerBackend uses the newer customer api, which logs in directly with the user's email and password
+type CustomerBackend struct {
+	BaseURL    string
+	httpClient *http.Client
+}
+
+type customerTokens struct {
+	IDToken      string `json:"idToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+type customerHouses struct {
+	OwnHouses []struct {
+		ID   ID     `json:"id"`
+		Name string `json:"name"`
+	} `json:"ownHouses"`
+}
+
+type customerRoom struct {
+	RoomID   ID               `json:"roomId"`
+	RoomName string           `json:"roomName"`
+	Devices  []customerDevice `json:"devices"`
+}
+
+type customerIndependentDevices struct {
+	Items []customerDevice `json:"items"`
+}
+
+type customerDevice struct {
+	DeviceID    ID     `json:"deviceId"`
+	CustomName  string `json:"customName"`
+	MacAddress  string `json:"macAddress"`
+	IsConnected bool   `json:"isConnected"`
+	// FirmwareVersion is only reported by some generations
+	FirmwareVersion string `json:"firmwareVersion"`
+	DeviceType      struct {
+		ParentType struct {
+			Name string `json:"name"`
+		} `json:"parentType"`
+		ChildType struct {
+			Name string `json:"name"`
+		} `json:"childType"`
+	} `json:"deviceType"`
+	LastMetrics struct {
+		TemperatureAmbient float32 `json:"temperatureAmbient"`
+		Temperature        float32 `json:"temperature"`
+		Humidity           float32 `json:"humidity"`
+		Eco2               float32 `json:"eco2"`
+		Tvoc               float32 `json:"tvoc"`
+		// HeaterFlag is 1 while the heater is heating
+		HeaterFlag int `json:"heaterFlag"`
+	} `json:"lastMetrics"`
+	DeviceSettings struct {
+		Reported struct {
+			TemperatureNormal float64 `json:"temperature_normal"`
+			OperationMode     string  `json:"operation_mode"`
+			PowerLevel        int     `json:"power_level"`
+		} `json:"reported"`
+	} `json:"deviceSettings"`
+}
+
+// NewCustomerBackend creates a backend for the customer api
+func NewCustomerBackend() *CustomerBackend {
+	return &CustomerBackend{BaseURL: customerBaseURL, httpClient: &http.Client{Timeout: requestTimeout}}
+}
+
+func (cb *CustomerBackend) NeedsAuthCode() bool {
+	return false
+}
+
+// Login signs in with email and password. authCode is not used by the customer api.
+func (cb *CustomerBackend) Login(ctx context.Context, authCode string, password string, username string) (string, string, int64, int64, error) {
+	body := map[string]string{"login": username, "password": password}
+	tokens := customerTokens{}
+	if err := cb.request(ctx, "POST", signInPath, "", body, &tokens); err != nil {
+		return "", "", 0, 0, err
+	}
+	return cb.tokensToTuple(tokens)
+}
+
+func (cb *CustomerBackend) RefreshToken(ctx context.Context, refreshToken string) (string, string, int64, int64, error) {
+	tokens := customerTokens{}
+	if err := cb.request(ctx, "POST", customerRefreshPath, refreshToken, nil, &tokens); err != nil {
+		return "", "", 0, 0, err
+	}
+	return cb.tokensToTuple(tokens)
+}
+
+func (cb *CustomerBackend) UpdateLists(ctx context.Context, accessToken string, hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}) ([]interface{}, []interface{}, []interface{}, []interface{}, error) {
+	if accessToken == "" {
+		return hc, rc, dc, idc, ErrUnauthorized
+	}
+	houses := customerHouses{}
+	if err := cb.request(ctx, "GET", housesPath, accessToken, nil, &houses); err != nil {
+		log.Error(fmt.Errorf("Can't get home list, error: %v", err))
+		return hc, rc, dc, idc, err
+	}
+	// A partial list is not returned, devices missing from it would be taken as removed from the account
+	homes, rooms, devices, independentDevices := hc, rc, dc, idc
+	for _, house := range houses.OwnHouses {
+		homes = append(homes, Home{HomeID: house.ID, HomeName: house.Name})
+
+		var houseRooms []customerRoom
+		if err := cb.request(ctx, "GET", fmt.Sprintf(houseDevicesPath, house.ID), accessToken, nil, &houseRooms); err != nil {
+			log.Error(fmt.Errorf("Can't get room list, error: %v", err))
+			return hc, rc, dc, idc, fmt.Errorf("can't get rooms of house %s: %w", house.ID, err)
+		}
+		for _, room := range houseRooms {
+			rooms = append(rooms, Room{RoomID: room.RoomID, RoomName: room.RoomName, Total: len(room.Devices)})
+			for _, device := range room.Devices {
+				roomDevice := device.toDevice()
+				roomDevice.RoomID = room.RoomID
+				roomDevice.RoomName = room.RoomName
+				roomDevice.HomeID = house.ID
+				roomDevice.HomeName = house.Name
+				devices = append(devices, roomDevice)
+			}
+		}
+
+		independent := customerIndependentDevices{}
+		if err := cb.request(ctx, "GET", fmt.Sprintf(houseIndependentDevicesPath, house.ID), accessToken, nil, &independent); err != nil {
+			log.Error(fmt.Errorf("Can't get independent device list, error: %v", err))
+			return hc, rc, dc, idc, fmt.Errorf("can't get independent devices of house %s: %w", house.ID, err)
+		}
+		for _, device := range independent.Items {
+			independentDevice := device.toDevice()
+			independentDevice.HomeID = house.ID
+			independentDevice.HomeName = house.Name
+			devices = append(devices, independentDevice)
+			independentDevices = append(independentDevices, independentDevice)
+		}
+	}
+	return homes, rooms, devices, independentDevices, nil
+}
+
+// ReadDevice gets the devices in rooms of the house, or the independent devices of the house if roomID is empty
+func (cb *CustomerBackend) ReadDevice(ctx context.Context, accessToken string, homeID string, roomID string, deviceID string) (Device, error) {
+	devices, err := cb.ReadDevices(ctx, accessToken, homeID, roomID)
+	if err != nil {
+		return Device{}, err
+	}
+	return findDevice(devices, deviceID)
+}
+
+// ReadDevices returns the devices in all rooms of the house, since they are listed by the same call, or the
+// independent devices of the house if roomID is empty
+func (cb *CustomerBackend) ReadDevices(ctx context.Context, accessToken string, homeID string, roomID string) ([]Device, error) {
+	var devices []Device
+	if roomID != "" {
+		var rooms []customerRoom
+		if err := cb.request(ctx, "GET", fmt.Sprintf(houseDevicesPath, homeID), accessToken, nil, &rooms); err != nil {
+			return nil, err
+		}
+		for _, room := range rooms {
+			for _, device := range room.Devices {
+				roomDevice := device.toDevice()
+				roomDevice.RoomID, roomDevice.RoomName, roomDevice.HomeID = room.RoomID, room.RoomName, ID(homeID)
+				devices = append(devices, roomDevice)
+			}
+		}
+		return devices, nil
+	}
+	independent := customerIndependentDevices{}
+	if err := cb.request(ctx, "GET", fmt.Sprintf(houseIndependentDevicesPath, homeID), accessToken, nil, &independent); err != nil {
+		return nil, err
+	}
+	for _, device := range independent.Items {
+		independentDevice := device.toDevice()
+		independentDevice.HomeID = ID(homeID)
+		devices = append(devices, independentDevice)
+	}
+	return devices, nil
+}
+
+// Ping gets the house list, the first call of UpdateLists
+func (cb *CustomerBackend) Ping(ctx context.Context, accessToken string) error {
+	if accessToken == "" {
+		return ErrUnauthorized
+	}
+	return cb.request(ctx, "GET", housesPath, accessToken, nil, &customerHouses{})
+}
+
+// DeviceControl sets normal temperature and switches the heater to individual control
+func (cb *CustomerBackend) DeviceControl(ctx context.Context, accessToken string, deviceId string, newTemp string) bool {
+	var temp float64
+	if _, err := fmt.Sscanf(newTemp, "%g", &temp); err != nil {
+		log.Error(fmt.Errorf("Can't controll device, error: %v", err))
+		return false
+	}
+	body := map[string]interface{}{
+		"deviceType": "Heaters",
+		"enabled":    true,
+		"settings": map[string]interface{}{
+			"operation_mode":     "control_individually",
+			"temperature_normal": temp,
+		},
+	}
+	if err := cb.request(ctx, "PATCH", fmt.Sprintf(deviceSettingsPath, deviceId), accessToken, body, nil); err != nil {
+		log.Debug("Error in DeviceControl: ", err)
+		return false
+	}
+	return true
+}
+
+func (d customerDevice) toDevice() Device {
+	device := Device{
+		DeviceID:        d.DeviceID,
+		DeviceName:      d.CustomName,
+		Mac:             d.MacAddress,
+		ModelName:       d.DeviceType.ChildType.Name,
+		ProductType:     d.DeviceType.ChildType.Name,
+		FirmwareVersion: d.FirmwareVersion,
+		CanChangeTemp:   1,
+		CurrentTemp:     d.LastMetrics.TemperatureAmbient,
+		HeaterFlag:      d.LastMetrics.HeaterFlag,
+		SetpointTemp:    float32(d.DeviceSettings.Reported.TemperatureNormal),
+	}
+	if device.ProductType == "" {
+		device.ProductType = d.DeviceType.ParentType.Name
+	}
+	if d.IsConnected {
+		device.DeviceStatus = 1
+	}
+	if d.DeviceSettings.Reported.OperationMode != "off" {
+		device.PowerStatus = 1
+	}
+	switch d.DeviceType.ParentType.Name {
+	case "Sockets":
+		device.DeviceType = model.DeviceTypeSocket
+		device.CanChangeTemp = 0
+		device.SetpointTemp = 0
+	case "Sensors":
+		// Sense sensors report measured temperature in temperature, they have no setpoint
+		device.DeviceType = model.DeviceTypeSensor
+		device.CanChangeTemp = 0
+		device.SetpointTemp = 0
+		device.CurrentTemp = d.LastMetrics.Temperature
+		device.Humidity = d.LastMetrics.Humidity
+		device.Co2 = d.LastMetrics.Eco2
+		device.Tvoc = d.LastMetrics.Tvoc
+	default:
+		device.DeviceType = model.DeviceTypeHeater
+		if strings.Contains(strings.ToLower(d.DeviceType.ChildType.Name), "oil") {
+			device.DeviceType = model.DeviceTypeOilHeater
+			device.PowerLevel = d.DeviceSettings.Reported.PowerLevel
+		}
+	}
+	return device
+}
+
+// SwitchControl turns socket on or off
+func (cb *CustomerBackend) SwitchControl(ctx context.Context, accessToken string, deviceId string, on bool) bool {
+	if err := cb.setOperationMode(ctx, accessToken, deviceId, "Sockets", on); err != nil {
+		log.Debug("Error in SwitchControl: ", err)
+		return false
+	}
+	return true
+}
+
+// SupportsDecimalSetpoint is true, temperature_normal takes decimals
+func (cb *CustomerBackend) SupportsDecimalSetpoint() bool {
+	return true
+}
+
+func (cb *CustomerBackend) SupportsModeControl() bool {
+	return true
+}
+
+// HeaterModeControl turns heater off, or back to control by its own setpoint
+func (cb *CustomerBackend) HeaterModeControl(ctx context.Context, accessToken string, deviceId string, on bool) bool {
+	if err := cb.setOperationMode(ctx, accessToken, deviceId, "Heaters", on); err != nil {
+		log.Debug("Error in HeaterModeControl: ", err)
+		return false
+	}
+	return true
+}
+
+// setOperationMode sets operation_mode of the device to off, or to control_individually when on
+func (cb *CustomerBackend) setOperationMode(ctx context.Context, accessToken string, deviceId string, deviceType string, on bool) error {
+	mode := "off"
+	if on {
+		mode = "control_individually"
+	}
+	body := map[string]interface{}{
+		"deviceType": deviceType,
+		"enabled":    on,
+		"settings": map[string]interface{}{
+			"operation_mode": mode,
+		},
+	}
+	return cb.request(ctx, "PATCH", fmt.Sprintf(deviceSettingsPath, deviceId), accessToken, body, nil)
+}
+
+func (cb *CustomerBackend) SupportsPowerLevel() bool {
+	return true
+}
+
+// SetPowerLevel selects power level of oil heater
+func (cb *CustomerBackend) SetPowerLevel(ctx context.Context, accessToken string, deviceId string, level int) bool {
+	body := map[string]interface{}{
+		"deviceType": "Heaters",
+		"enabled":    true,
+		"settings": map[string]interface{}{
+			"power_level": level,
+		},
+	}
+	if err := cb.request(ctx, "PATCH", fmt.Sprintf(deviceSettingsPath, deviceId), accessToken, body, nil); err != nil {
+		log.Debug("Error in SetPowerLevel: ", err)
+		return false
+	}
+	return true
+}
+
+func (cb *CustomerBackend) tokensToTuple(tokens customerTokens) (string, string, int64, int64, error) {
+	if tokens.IDToken == "" {
+		return "", "", 0, 0, fmt.Errorf("no token in login response")
+	}
+	now := time.Now()
+	expireTime := jwtExpireTime(tokens.IDToken, now.Add(10*time.Minute))
+	refreshExpireTime := jwtExpireTime(tokens.RefreshToken, now.Add(refreshTokenLifetime))
+	return tokens.IDToken, tokens.RefreshToken, expireTime, refreshExpireTime, nil
+}
+
+// jwtExpireTime reads the exp claim of a jwt as unix millis, or returns fallback if token can't be parsed
+func jwtExpireTime(token string, fallback time.Time) int64 {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		claims := struct {
+			Exp int64 `json:"exp"`
+		}{}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err == nil && json.Unmarshal(payload, &claims) == nil && claims.Exp > 0 {
+			return claims.Exp * 1000
+		}
+	}
+	return fallback.UnixNano() / 1000000
+}
+
+func (cb *CustomerBackend) request(ctx context.Context, method, path, token string, body interface{}, holder interface{}) error {
+	var reqBody *bytes.Reader
+	if body != nil {
+		payloadBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(payloadBytes)
+	} else {
+		reqBody = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cb.BaseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := cb.httpClient.Do(req)
+	if holder == nil {
+		holder = &json.RawMessage{}
+	}
+	return processHTTPResponse(resp, err, holder)
+}
@@ -0,0 +1,201 @@
+package mill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/thingsplex/mill/internal/standin"
+	"github.com/thingsplex/mill/model"
+)
+
+// customerAccount is a customer api account with one house, a panel heater and an oil heater in a room and an
+// independent socket
+var customerAccount = map[string]standin.Response{
+	"GET /houses": standin.OK(`{"ownHouses":[{"id":"h1","name":"Home"}]}`),
+	"GET /houses/h1/devices": standin.OK(`[{"roomId":"r1","roomName":"Living room","devices":[
+		{"deviceId":"d1","customName":"Heater","isConnected":true,"deviceType":{"parentType":{"name":"Heaters"},"childType":{"name":"Panel Heater Gen. 3"}},"lastMetrics":{"temperatureAmbient":21.5,"heaterFlag":1},"deviceSettings":{"reported":{"temperature_normal":21.5,"operation_mode":"control_individually"}}},
+		{"deviceId":"d2","customName":"Oil heater","isConnected":true,"deviceType":{"parentType":{"name":"Heaters"},"childType":{"name":"Oil Heater Gen. 3"}},"deviceSettings":{"reported":{"temperature_normal":20,"operation_mode":"off","power_level":2}}}]}]`),
+	"GET /houses/h1/devices/independent": standin.OK(`{"items":[{"deviceId":"d3","customName":"Socket","isConnected":false,"deviceType":{"parentType":{"name":"Sockets"},"childType":{"name":"WiFi Socket Gen. 3"}},"deviceSettings":{"reported":{"operation_mode":"control_individually"}}}]}`),
+}
+
+func newCustomerStandIn(changes map[string]standin.Response) (*standin.Server, *CustomerBackend) {
+	responses := make(map[string]standin.Response)
+	for route, resp := range customerAccount {
+		responses[route] = resp
+	}
+	for route, resp := range changes {
+		responses[route] = resp
+	}
+	si := standin.New(responses)
+	backend := NewCustomerBackend()
+	backend.BaseURL = si.URL + "/"
+	return si, backend
+}
+
+func TestCustomerUpdateLists(t *testing.T) {
+	si, backend := newCustomerStandIn(nil)
+	defer si.Close()
+
+	homes, rooms, devices, independent, err := backend.UpdateLists(context.Background(), "access", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(homes) != 1 || len(rooms) != 1 || len(devices) != 3 || len(independent) != 1 {
+		t.Fatalf("got %d homes, %d rooms, %d devices and %d independent devices", len(homes), len(rooms), len(devices), len(independent))
+	}
+	heater := devices[0].(Device)
+	if heater.DeviceID != "d1" || heater.HomeID != "h1" || heater.RoomID != "r1" || heater.DeviceType != model.DeviceTypeHeater || heater.SetpointTemp != 21.5 || heater.CurrentTemp != 21.5 || heater.PowerStatus != 1 || heater.DeviceStatus != 1 {
+		t.Errorf("unexpected heater %+v", heater)
+	}
+	if !model.IsHeating(heater) {
+		t.Error("heater is not heating, expected heaterFlag from last metrics")
+	}
+	oilHeater := devices[1].(Device)
+	if model.IsHeating(oilHeater) {
+		t.Error("oil heater without heaterFlag is heating")
+	}
+	if oilHeater.DeviceType != model.DeviceTypeOilHeater || oilHeater.PowerLevel != 2 || oilHeater.PowerStatus != 0 {
+		t.Errorf("unexpected oil heater %+v", oilHeater)
+	}
+	socket := independent[0].(Device)
+	if socket.DeviceID != "d3" || socket.HomeID != "h1" || socket.DeviceType != model.DeviceTypeSocket || socket.CanChangeTemp != 0 || socket.DeviceStatus != 0 {
+		t.Errorf("unexpected socket %+v", socket)
+	}
+	if got := si.Received("GET /houses"); len(got) != 1 || got[0].Header.Get("Authorization") != "Bearer access" {
+		t.Errorf("unexpected house requests %+v", got)
+	}
+}
+
+func TestCustomerUpdateListsKeepsListsOnPartialFetch(t *testing.T) {
+	si, backend := newCustomerStandIn(map[string]standin.Response{
+		"GET /houses/h1/devices/independent": {Status: http.StatusInternalServerError},
+	})
+	defer si.Close()
+
+	lastHomes, lastDevices := []interface{}{Home{HomeID: "h1"}}, []interface{}{Device{DeviceID: "d1"}, Device{DeviceID: "d3"}}
+	homes, rooms, devices, independent, err := backend.UpdateLists(context.Background(), "access", lastHomes, nil, lastDevices, nil)
+	if err == nil {
+		t.Fatal("partial fetch succeeded")
+	}
+	if !reflect.DeepEqual(homes, lastHomes) || rooms != nil || !reflect.DeepEqual(devices, lastDevices) || independent != nil {
+		t.Errorf("lists were changed by a partial fetch")
+	}
+}
+
+func TestCustomerErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		status       int
+		unauthorized bool
+	}{
+		"http 401": {status: http.StatusUnauthorized, unauthorized: true},
+		"http 403": {status: http.StatusForbidden, unauthorized: true},
+		"http 429": {status: http.StatusTooManyRequests},
+		"http 500": {status: http.StatusInternalServerError},
+	} {
+		t.Run(name, func(t *testing.T) {
+			si, backend := newCustomerStandIn(map[string]standin.Response{"GET /houses": {Status: test.status}})
+			defer si.Close()
+			_, _, _, _, err := backend.UpdateLists(context.Background(), "access", nil, nil, nil, nil)
+			if err == nil {
+				t.Fatal("error was not returned")
+			}
+			if errors.Is(err, ErrUnauthorized) != test.unauthorized {
+				t.Errorf("error %q, unauthorized %v expected", err, test.unauthorized)
+			}
+		})
+	}
+}
+
+func TestCustomerLogin(t *testing.T) {
+	si, backend := newCustomerStandIn(map[string]standin.Response{
+		"POST /customer/auth/sign-in": standin.OK(`{"idToken":"id","refreshToken":"refresh"}`),
+	})
+	defer si.Close()
+
+	accessToken, refreshToken, expireTime, refreshExpireTime, err := backend.Login(context.Background(), "", "secret", "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != "id" || refreshToken != "refresh" || expireTime == 0 || refreshExpireTime <= expireTime {
+		t.Errorf("got tokens %s, %s expiring at %d, %d", accessToken, refreshToken, expireTime, refreshExpireTime)
+	}
+	sent := map[string]string{}
+	if got := si.Received("POST /customer/auth/sign-in"); len(got) != 1 || json.Unmarshal([]byte(got[0].Body), &sent) != nil || sent["login"] != "user@example.com" || sent["password"] != "secret" {
+		t.Errorf("unexpected sign-in requests %+v", got)
+	}
+}
+
+func TestCustomerDeviceControl(t *testing.T) {
+	for name, test := range map[string]struct {
+		resp     standin.Response
+		temp     string
+		accepted bool
+		sent     bool
+	}{
+		"accepted":     {resp: standin.OK(`{}`), temp: "21.5", accepted: true, sent: true},
+		"empty body":   {resp: standin.OK(``), temp: "21.5", accepted: true, sent: true},
+		"http 500":     {resp: standin.Response{Status: http.StatusInternalServerError}, temp: "21.5", sent: true},
+		"bad setpoint": {resp: standin.OK(`{}`), temp: "warm"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			si, backend := newCustomerStandIn(map[string]standin.Response{"PATCH /devices/d1/settings": test.resp})
+			defer si.Close()
+			if accepted := backend.DeviceControl(context.Background(), "access", "d1", test.temp); accepted != test.accepted {
+				t.Errorf("DeviceControl returned %v", accepted)
+			}
+			got := si.Received("PATCH /devices/d1/settings")
+			if !test.sent {
+				if len(got) != 0 {
+					t.Errorf("invalid setpoint was sent to Mill")
+				}
+				return
+			}
+			sent := struct {
+				DeviceType string `json:"deviceType"`
+				Settings   struct {
+					OperationMode     string  `json:"operation_mode"`
+					TemperatureNormal float64 `json:"temperature_normal"`
+				} `json:"settings"`
+			}{}
+			if len(got) != 1 || json.Unmarshal([]byte(got[0].Body), &sent) != nil {
+				t.Fatalf("unexpected control requests %+v", got)
+			}
+			if sent.DeviceType != "Heaters" || sent.Settings.OperationMode != "control_individually" || sent.Settings.TemperatureNormal != 21.5 {
+				t.Errorf("sent %+v", sent)
+			}
+		})
+	}
+}
+
+func TestCustomerHeaterModeControl(t *testing.T) {
+	si, backend := newCustomerStandIn(map[string]standin.Response{"PATCH /devices/d1/settings": standin.OK(`{}`)})
+	defer si.Close()
+
+	_, _, devices, _, err := backend.UpdateLists(context.Background(), "access", nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := model.NetworkService{ModeControl: backend.SupportsModeControl()}
+	if thermostat := findService(ns.SendInclusionReport(0, devices), "thermostat"); thermostat == nil || !hasInterface(thermostat, "cmd.mode.set") {
+		t.Fatalf("cloud heater can't be turned off, thermostat %+v", thermostat)
+	}
+	if !backend.HeaterModeControl(context.Background(), "access", "d1", false) {
+		t.Fatal("HeaterModeControl failed")
+	}
+	sent := struct {
+		DeviceType string `json:"deviceType"`
+		Settings   struct {
+			OperationMode string `json:"operation_mode"`
+		} `json:"settings"`
+	}{}
+	if got := si.Received("PATCH /devices/d1/settings"); len(got) != 1 || json.Unmarshal([]byte(got[0].Body), &sent) != nil {
+		t.Fatalf("unexpected control requests %+v", got)
+	}
+	if sent.DeviceType != "Heaters" || sent.Settings.OperationMode != "off" {
+		t.Errorf("sent %+v", sent)
+	}
+}
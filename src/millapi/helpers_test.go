@@ -0,0 +1,25 @@
+package mill
+
+import (
+	"github.com/futurehomeno/fimpgo/fimptype"
+)
+
+// findService returns the service of the inclusion report by name, nil if the device doesn't have it
+func findService(report fimptype.ThingInclusionReport, name string) *fimptype.Service {
+	for i := range report.Services {
+		if report.Services[i].Name == name {
+			return &report.Services[i]
+		}
+	}
+	return nil
+}
+
+// hasInterface tells if the service has an interface with msgType
+func hasInterface(service *fimptype.Service, msgType string) bool {
+	for _, intf := range service.Interfaces {
+		if intf.MsgType == msgType {
+			return true
+		}
+	}
+	return false
+}
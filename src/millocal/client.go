@@ -0,0 +1,164 @@
+package millocal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// statusPath returns name, firmware version and operation key of the heater
+	statusPath = "/status"
+	// controlStatusPath returns ambient temperature, set temperature and power state
+	controlStatusPath = "/control-status"
+	// setTemperaturePath changes the set temperature for the given temperature type
+	setTemperaturePath = "/set-temperature"
+	// operationModePath reads or changes the operation mode of the heater
+	operationModePath = "/operation-mode"
+
+	// TemperatureTypeNormal is the temperature used when the heater is controlled individually
+	TemperatureTypeNormal = "Normal"
+
+	OperationModeOff                 = "Off"
+	OperationModeWeeklyProgram       = "Weekly program"
+	OperationModeIndependentDevice   = "Independent device"
+	OperationModeControlIndividually = "Control individually"
+
+	defaultTimeout = 5 * time.Second
+)
+
+// Client talks to a Mill Gen 3 heater over the local network
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// Status is the response from /status
+type Status struct {
+	Name         string `json:"name"`
+	CustomName   string `json:"custom_name"`
+	Version      string `json:"version"`
+	OperationKey string `json:"operation_key"`
+	Status       string `json:"status"`
+}
+
+// ControlStatus is the response from /control-status
+type ControlStatus struct {
+	AmbientTemperature    float32 `json:"ambient_temperature"`
+	RawAmbientTemperature float32 `json:"raw_ambient_temperature"`
+	SetTemperature        float32 `json:"set_temperature"`
+	CurrentPower          float32 `json:"current_power"`
+	ControlSignal         float32 `json:"control_signal"`
+	SwitchedOn            bool    `json:"switched_on"`
+	ConnectedToCloud      bool    `json:"connected_to_cloud"`
+	OperationMode         string  `json:"operation_mode"`
+	Status                string  `json:"status"`
+}
+
+type operationMode struct {
+	Mode   string `json:"mode"`
+	Status string `json:"status,omitempty"`
+}
+
+type setTemperature struct {
+	Type  string  `json:"type"`
+	Value float32 `json:"value"`
+}
+
+// NewClient creates a client for the heater at the given address. Address can be a plain ip, ip:port or a full url.
+func NewClient(address string) *Client {
+	baseURL := strings.TrimRight(address, "/")
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+	return &Client{baseURL: baseURL, httpClient: &http.Client{Timeout: defaultTimeout}}
+}
+
+// GetStatus returns general information about the heater
+func (c *Client) GetStatus() (*Status, error) {
+	status := &Status{}
+	if err := c.do("GET", statusPath, nil, status); err != nil {
+		return nil, err
+	}
+	return status, checkStatus(status.Status)
+}
+
+// GetControlStatus returns current temperature, set temperature and operation mode
+func (c *Client) GetControlStatus() (*ControlStatus, error) {
+	status := &ControlStatus{}
+	if err := c.do("GET", controlStatusPath, nil, status); err != nil {
+		return nil, err
+	}
+	return status, checkStatus(status.Status)
+}
+
+// SetTemperature sets normal temperature of the heater. Decimals are supported by the local api.
+func (c *Client) SetTemperature(temp float32) error {
+	resp := &operationMode{}
+	if err := c.do("POST", setTemperaturePath, setTemperature{Type: TemperatureTypeNormal, Value: temp}, resp); err != nil {
+		return err
+	}
+	return checkStatus(resp.Status)
+}
+
+// GetOperationMode returns operation mode of the heater
+func (c *Client) GetOperationMode() (string, error) {
+	resp := &operationMode{}
+	if err := c.do("GET", operationModePath, nil, resp); err != nil {
+		return "", err
+	}
+	return resp.Mode, checkStatus(resp.Status)
+}
+
+// SetOperationMode changes operation mode of the heater. Use one of the OperationMode constants.
+func (c *Client) SetOperationMode(mode string) error {
+	resp := &operationMode{}
+	if err := c.do("POST", operationModePath, operationMode{Mode: mode}, resp); err != nil {
+		return err
+	}
+	return checkStatus(resp.Status)
+}
+
+func (c *Client) do(method, path string, body interface{}, holder interface{}) error {
+	var reqBody *bytes.Reader
+	if body != nil {
+		payloadBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(payloadBytes)
+	} else {
+		reqBody = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		log.Debug("<millocal> Heater does not respond. Error: ", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("bad HTTP return code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(holder)
+}
+
+// Local api answers with status "ok" on success. Empty status is accepted since not all endpoints return it.
+func checkStatus(status string) error {
+	if status != "" && status != "ok" {
+		return fmt.Errorf("heater responded with status %q", status)
+	}
+	return nil
+}
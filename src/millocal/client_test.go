@@ -0,0 +1,109 @@
+package millocal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/thingsplex/mill/internal/standin"
+)
+
+// newHeater serves canned local api responses by method and path
+func newHeater(responses map[string]string) *standin.Server {
+	return standin.New(standin.Responses(responses))
+}
+
+// body returns the last request body the heater received on route
+func body(h *standin.Server, route string) string {
+	received := h.Received(route)
+	if len(received) == 0 {
+		return ""
+	}
+	return received[len(received)-1].Body
+}
+
+func TestGetControlStatus(t *testing.T) {
+	h := newHeater(map[string]string{
+		"GET /control-status": `{"ambient_temperature":21.25,"set_temperature":22.5,"switched_on":true,"operation_mode":"Control individually","status":"ok"}`,
+	})
+	defer h.Close()
+
+	status, err := NewClient(h.URL + "/").GetControlStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.AmbientTemperature != 21.25 || status.SetTemperature != 22.5 || !status.SwitchedOn || status.OperationMode != OperationModeControlIndividually {
+		t.Errorf("unexpected control status %+v", status)
+	}
+}
+
+func TestSetTemperature(t *testing.T) {
+	h := newHeater(map[string]string{"POST /set-temperature": `{"status":"ok"}`})
+	defer h.Close()
+
+	if err := NewClient(h.URL).SetTemperature(19.5); err != nil {
+		t.Fatal(err)
+	}
+	sent := setTemperature{}
+	if err := json.Unmarshal([]byte(body(h, "POST /set-temperature")), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Type != TemperatureTypeNormal || sent.Value != 19.5 {
+		t.Errorf("sent %+v, expected normal temperature 19.5", sent)
+	}
+}
+
+func TestOperationMode(t *testing.T) {
+	h := newHeater(map[string]string{
+		"GET /operation-mode":  `{"mode":"Weekly program","status":"ok"}`,
+		"POST /operation-mode": `{"status":"ok"}`,
+	})
+	defer h.Close()
+
+	client := NewClient(h.URL)
+	mode, err := client.GetOperationMode()
+	if err != nil || mode != OperationModeWeeklyProgram {
+		t.Errorf("got mode %q and error %v", mode, err)
+	}
+	if err := client.SetOperationMode(OperationModeOff); err != nil {
+		t.Fatal(err)
+	}
+	if body := body(h, "POST /operation-mode"); body != `{"mode":"Off"}` {
+		t.Errorf("sent %s", body)
+	}
+}
+
+func TestHeaterErrors(t *testing.T) {
+	h := newHeater(map[string]string{
+		"GET /status":         `{"name":"Mill","status":"ok"}`,
+		"GET /control-status": `{"status":"failed_to_read"}`,
+	})
+	defer h.Close()
+
+	client := NewClient(h.URL)
+	if _, err := client.GetStatus(); err != nil {
+		t.Errorf("status without version failed: %v", err)
+	}
+	if _, err := client.GetControlStatus(); err == nil {
+		t.Error("status other than ok was accepted")
+	}
+	if err := client.SetTemperature(20); err == nil {
+		t.Error("HTTP 404 was accepted")
+	}
+	h.Close()
+	if _, err := client.GetStatus(); err == nil {
+		t.Error("heater that doesn't respond was accepted")
+	}
+}
+
+func TestNewClientAddress(t *testing.T) {
+	for address, expected := range map[string]string{
+		"192.168.1.20":            "http://192.168.1.20",
+		"192.168.1.20:8080":       "http://192.168.1.20:8080",
+		"http://192.168.1.20/":    "http://192.168.1.20",
+		"https://heater.local:81": "https://heater.local:81",
+	} {
+		if baseURL := NewClient(address).baseURL; baseURL != expected {
+			t.Errorf("address %s gave %s, expected %s", address, baseURL, expected)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AddressScheme is the version of the service address format. Things announced with an older scheme
+// are announced again, see States.AddressScheme.
+const AddressScheme = 2
+
+// ServiceAddress identifies a Mill device in service topics, e.g. /rt:dev/rn:mill/ad:1/sv:thermostat/ad:1_201712345678_201712345679.
+// It is encoded as <instance>_<homeID>_<deviceID>. Mill ids are numbers or uuids, so they never contain "_".
+// Thing addresses in inclusion and exclusion reports are plain deviceIDs, so things keep their address and room
+// placement in Futurehome when the service address format changes.
+type ServiceAddress struct {
+	// Instance is the adapter instance of the Mill account, empty for addresses from scheme 1. Commands addressed to
+	// another instance are rejected.
+	Instance string
+	// HomeID keeps addresses of devices with the same id in different homes apart. Devices are looked up by
+	// DeviceID only, so commands reach a device moved to another home before it is announced again.
+	HomeID   string
+	DeviceID string
+}
+
+// NewServiceAddress returns service address of a device. Empty instance means the main account.
+func NewServiceAddress(instance string, homeID string, deviceID string) ServiceAddress {
+	if instance == "" {
+		instance = "1"
+	}
+	return ServiceAddress{Instance: instance, HomeID: homeID, DeviceID: deviceID}
+}
+
+func (sa ServiceAddress) String() string {
+	return sa.Instance + "_" + sa.HomeID + "_" + sa.DeviceID
+}
+
+// ParseServiceAddress decodes a service address. Scheme 1 addresses, the plain deviceID with optional "l" prefix
+// and "_0" suffix, are accepted as well, so commands to things not yet announced again keep working.
+func ParseServiceAddress(address string) (ServiceAddress, error) {
+	parts := strings.Split(address, "_")
+	switch {
+	case len(parts) == 3 && parts[0] != "" && parts[2] != "":
+		return ServiceAddress{Instance: parts[0], HomeID: parts[1], DeviceID: parts[2]}, nil
+	case len(parts) == 1 || (len(parts) == 2 && parts[1] == "0"):
+		deviceID := strings.TrimPrefix(parts[0], "l")
+		if deviceID != "" {
+			return ServiceAddress{DeviceID: deviceID}, nil
+		}
+	}
+	return ServiceAddress{}, fmt.Errorf("invalid service address %q", address)
+}
@@ -0,0 +1,49 @@
+package model
+
+import "testing"
+
+func TestParseServiceAddress(t *testing.T) {
+	for address, expected := range map[string]ServiceAddress{
+		"1_201712345678_201712345679": {Instance: "1", HomeID: "201712345678", DeviceID: "201712345679"},
+		"2__401":                      {Instance: "2", DeviceID: "401"},
+		"1_4b3f6c2e-8d1a-4e5b-9c7d-0a1b2c3d4e5f_9e8d7c6b-5a4f-3e2d-1c0b-a9f8e7d6c5b4": {Instance: "1", HomeID: "4b3f6c2e-8d1a-4e5b-9c7d-0a1b2c3d4e5f", DeviceID: "9e8d7c6b-5a4f-3e2d-1c0b-a9f8e7d6c5b4"},
+		// Scheme 1
+		"l401_0":                               {DeviceID: "401"},
+		"401_0":                                {DeviceID: "401"},
+		"401":                                  {DeviceID: "401"},
+		"9e8d7c6b-5a4f-3e2d-1c0b-a9f8e7d6c5b4": {DeviceID: "9e8d7c6b-5a4f-3e2d-1c0b-a9f8e7d6c5b4"},
+	} {
+		parsed, err := ParseServiceAddress(address)
+		if err != nil {
+			t.Errorf("%s: %v", address, err)
+		} else if parsed != expected {
+			t.Errorf("%s was parsed as %+v, expected %+v", address, parsed, expected)
+		}
+	}
+}
+
+func TestParseInvalidServiceAddress(t *testing.T) {
+	for _, address := range []string{"", "l", "l_0", "401_1", "1_h1_d1_extra", "_h1_d1", "1_h1_"} {
+		if parsed, err := ParseServiceAddress(address); err == nil {
+			t.Errorf("%q was parsed as %+v", address, parsed)
+		}
+	}
+}
+
+func TestServiceAddressRoundTrip(t *testing.T) {
+	for _, address := range []ServiceAddress{
+		NewServiceAddress("", "201712345678", "201712345679"),
+		NewServiceAddress("2", "4b3f6c2e-8d1a-4e5b-9c7d-0a1b2c3d4e5f", "9e8d7c6b-5a4f-3e2d-1c0b-a9f8e7d6c5b4"),
+		NewServiceAddress("3", "", "401"),
+	} {
+		parsed, err := ParseServiceAddress(address.String())
+		if err != nil {
+			t.Errorf("%s: %v", address, err)
+		} else if parsed != address {
+			t.Errorf("%s was parsed as %+v, expected %+v", address, parsed, address)
+		}
+	}
+	if instance := NewServiceAddress("", "h1", "d1").Instance; instance != "1" {
+		t.Errorf("address without instance has instance %q, expected the main account", instance)
+	}
+}
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrUnauthorized is returned when Mill rejects the access token, and the user has to log in again
+var ErrUnauthorized = errors.New("access token rejected")
+
+// Sources of app errors. An error is cleared when the next call of the same kind succeeds.
+const (
+	ErrorSourceAPI     = "api"
+	ErrorSourceAuth    = "auth"
+	ErrorSourceControl = "control"
+)
+
+// AppError is an unresolved error of the app, reported in app state and the errors field of the manifest
+type AppError struct {
+	Source string `json:"source"`
+	Code   string `json:"code"`
+	Text   string `json:"text"`
+	// At is when the error occurred. An error that keeps occurring keeps its first time.
+	At time.Time `json:"at"`
+}
+
+// SetError records an error of source, replacing the previous error of the same source. Listeners get a state
+// event when the error is new or its code changed.
+func (al *Lifecycle) SetError(source string, code string, text string) {
+	al.stateMux.Lock()
+	if al.appErrors == nil {
+		al.appErrors = make(map[string]AppError)
+	}
+	current, ok := al.appErrors[source]
+	changed := !ok || current.Code != code
+	at := time.Now()
+	if !changed {
+		at = current.At
+	}
+	al.appErrors[source] = AppError{Source: source, Code: code, Text: text, At: at}
+	al.stateMux.Unlock()
+	if changed {
+		al.broadcastState(StateKindError, State(code), nil)
+	}
+}
+
+// ClearError removes the error of source once the condition is resolved
+func (al *Lifecycle) ClearError(source string) {
+	al.stateMux.Lock()
+	_, ok := al.appErrors[source]
+	delete(al.appErrors, source)
+	al.stateMux.Unlock()
+	if ok {
+		al.broadcastState(StateKindError, "", nil)
+	}
+}
+
+// LastError returns texts of all unresolved errors, latest first, as shown in the errors field of the manifest
+func (al *Lifecycle) LastError() string {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
+	var texts []string
+	for _, appErr := range al.sortedErrors() {
+		texts = append(texts, appErr.Text+" (since "+appErr.At.Format("2006-01-02 15:04")+")")
+	}
+	return strings.Join(texts, "\n")
+}
+
+// sortedErrors returns unresolved errors, latest first. Caller must hold stateMux.
+func (al *Lifecycle) sortedErrors() []AppError {
+	appErrors := make([]AppError, 0, len(al.appErrors))
+	for _, appErr := range al.appErrors {
+		appErrors = append(appErrors, appErr)
+	}
+	sort.Slice(appErrors, func(i, j int) bool {
+		return appErrors[i].At.After(appErrors[j].At)
+	})
+	return appErrors
+}
@@ -0,0 +1,67 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// ControlTypeTemperature devices are controlled by setpoint
+	ControlTypeTemperature = 0
+	// ControlTypeSwitch devices are only switched on and off by the Mill cloud, setpoint can't be changed
+	ControlTypeSwitch = 1
+)
+
+// CatalogEntry describes a Mill product identified by subDomainId
+type CatalogEntry struct {
+	ModelName string
+}
+
+// deviceCatalog maps subDomainId reported by the open api to product name. Mill does not publish what subDomainId
+// values mean, and the entries below are not confirmed by a Mill source, so they only name the model in inclusion
+// reports and never decide which services a device gets. Open api devices are included as heaters, since a heater
+// included as anything else would lose its thermostat. Ids not listed here are logged
+// once by millapi and sent as sub_domain_id in the inclusion report, so entries can be checked against real devices.
+// Customer api devices have no subDomainId, they are identified by the device type the api reports, see
+// Device.ProductType in millapi.
+var deviceCatalog = map[int]CatalogEntry{
+	863:  {ModelName: "Mill Panel Heater Gen 1"},
+	5332: {ModelName: "Mill Panel Heater Gen 2"},
+	5333: {ModelName: "Mill Convection Heater Gen 2"},
+	6933: {ModelName: "Mill Oil Heater"},
+	6934: {ModelName: "Mill Oil Heater Gen 3"},
+	5316: {ModelName: "Mill Wi-Fi Socket"},
+	5317: {ModelName: "Mill Wi-Fi Socket Gen 3"},
+}
+
+// LookupCatalog returns product for subDomainId. Unknown products are named as generic heaters.
+func LookupCatalog(subDomainID int) (CatalogEntry, bool) {
+	entry, ok := deviceCatalog[subDomainID]
+	if !ok {
+		return CatalogEntry{ModelName: "Mill Heater"}, false
+	}
+	return entry, true
+}
+
+// ProductHash identifies product type across devices, e.g. mill_5332 for open api devices and mill_panelheatergen3
+// for customer api devices with product type PanelHeaterGen3
+func ProductHash(subDomainID int, productType string) string {
+	switch {
+	case subDomainID != 0:
+		return ServiceName + "_" + strconv.Itoa(subDomainID)
+	case productType != "":
+		return ServiceName + "_" + strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, productType)
+	}
+	return ServiceName
+}
+
+// CanSetTemperature tells if setpoint of the device can be changed through the adapter
+func CanSetTemperature(canChangeTemp int, controlType int) bool {
+	return canChangeTemp != 0 && controlType == ControlTypeTemperature
+}
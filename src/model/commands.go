@@ -0,0 +1,78 @@
+package model
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// Command states sent as "state" property of reports on services with a pending command
+const (
+	CommandStatePending     = "pending"
+	CommandStateConfirmed   = "confirmed"
+	CommandStateUnconfirmed = "unconfirmed"
+)
+
+// PendingCommand is a command sent to Mill which is not yet confirmed by reading the device back
+type PendingCommand struct {
+	Service  string
+	Value    string
+	IssuedAt time.Time
+}
+
+// SetPending records a command sent to the device. A newer command on the same service replaces the older one.
+func (st *States) SetPending(deviceID string, cmd PendingCommand) {
+	st.commandsMux.Lock()
+	defer st.commandsMux.Unlock()
+	if st.pending == nil {
+		st.pending = make(map[string]PendingCommand)
+	}
+	st.pending[deviceID+"/"+cmd.Service] = cmd
+}
+
+// Pending returns the unconfirmed command on a service of the device
+func (st *States) Pending(deviceID string, service string) (PendingCommand, bool) {
+	st.commandsMux.Lock()
+	defer st.commandsMux.Unlock()
+	cmd, ok := st.pending[deviceID+"/"+service]
+	return cmd, ok
+}
+
+// ClearPending removes cmd once it is confirmed or failed. Returns false if cmd was replaced by a newer command.
+func (st *States) ClearPending(deviceID string, cmd PendingCommand) bool {
+	st.commandsMux.Lock()
+	defer st.commandsMux.Unlock()
+	key := deviceID + "/" + cmd.Service
+	if current, ok := st.pending[key]; !ok || !current.IssuedAt.Equal(cmd.IssuedAt) {
+		return false
+	}
+	delete(st.pending, key)
+	return true
+}
+
+// MarkCommand records that a command was sent to the device, so the poller polls it more often for a while
+func (st *States) MarkCommand(deviceID string, at time.Time) {
+	st.commandsMux.Lock()
+	defer st.commandsMux.Unlock()
+	if st.commandAt == nil {
+		st.commandAt = make(map[string]time.Time)
+	}
+	st.commandAt[deviceID] = at
+}
+
+// LastCommand returns when the last command was sent to the device, zero time if none since start
+func (st *States) LastCommand(deviceID string) time.Time {
+	st.commandsMux.Lock()
+	defer st.commandsMux.Unlock()
+	return st.commandAt[deviceID]
+}
+
+// SameValue compares numeric values like setpoints, "21" and "21.0" are the same value
+func SameValue(a string, b string) bool {
+	af, errA := strconv.ParseFloat(a, 64)
+	bf, errB := strconv.ParseFloat(b, 64)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return math.Abs(af-bf) < 0.05
+}
@@ -6,6 +6,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/futurehomeno/fimpgo"
@@ -17,6 +20,7 @@ const ServiceName = "mill"
 
 type Configs struct {
 	path               string
+	instance           string
 	InstanceAddress    string `json:"instance_address"`
 	MqttServerURI      string `json:"mqtt_server_uri"`
 	MqttUsername       string `json:"mqtt_server_username"`
@@ -31,6 +35,17 @@ type Configs struct {
 	Param1             bool   `json:"param_1"`
 	Param2             string `json:"param_2"`
 	PollTimeMin        string `json:"poll_time_min"`
+	ApiBackend         string `json:"api_backend"` // legacy or customer, see millapi.NewBackend
+	RemovalGraceMin    string `json:"removal_grace_min"`
+	ReportThreshold    string `json:"report_threshold"` // temperature change in °C that is published before heartbeat
+	HeartbeatMin       string `json:"heartbeat_min"`
+	OutageGraceMin     string `json:"outage_grace_min"` // minutes Mill can be unreachable before devices are reported down
+	// RoomMapping maps Mill roomID to Futurehome room id, so new devices are placed in the right room
+	RoomMapping map[string]string `json:"room_mapping"`
+	// SelectedHomes are Mill homeIDs managed by this hub. Empty means all homes on the account.
+	SelectedHomes []string `json:"selected_homes"`
+	// DevicePollTime overrides poll time in minutes of single devices, keyed by Mill deviceID
+	DevicePollTime map[string]int `json:"device_poll_time"`
 
 	Username string `json:"username"` // this should be moved
 	Password string `json:"password"` // this should be moved
@@ -45,13 +60,20 @@ type Configs struct {
 
 	ConnectionState string `json:"connection_state"`
 	Errors          string `json:"errors"`
+	SyncStatus      string `json:"sync_status"`
 	HubToken        string `json:"token"`
 	UID             string `json:"uid"`
 }
 
 func NewConfigs(workDir string) *Configs {
-	conf := &Configs{WorkDir: workDir}
-	conf.path = filepath.Join(workDir, "data", "config.json")
+	return NewInstanceConfigs(workDir, "1")
+}
+
+// NewInstanceConfigs loads config of an adapter instance. Instance 1 is the main instance in config.json,
+// every additional Mill account has its own config_<instance>.json.
+func NewInstanceConfigs(workDir string, instance string) *Configs {
+	conf := &Configs{WorkDir: workDir, instance: instance}
+	conf.path = filepath.Join(workDir, "data", instanceFileName("config", instance))
 	if !utils.FileExists(conf.path) {
 		log.Info("Config file doesn't exist.Loading default config")
 		defaultConfigFile := filepath.Join(workDir, "defaults", "config.json")
@@ -73,6 +95,8 @@ func (cf *Configs) LoadFromFile() error {
 	if err != nil {
 		return err
 	}
+	// Instance address follows the file, so a config copied from defaults gets the right address
+	cf.InstanceAddress = cf.instance
 	return nil
 }
 
@@ -96,11 +120,43 @@ func (cf *Configs) GetDefaultDir() string {
 }
 
 func (cf *Configs) LoadDefaults() error {
-	configFile := filepath.Join(cf.WorkDir, "data", "config.json")
-	os.Remove(configFile)
+	os.Remove(cf.path)
 	log.Info("Config file doesn't exist.Loading default config")
 	defaultConfigFile := filepath.Join(cf.WorkDir, "defaults", "config.json")
-	return utils.CopyFile(defaultConfigFile, configFile)
+	return utils.CopyFile(defaultConfigFile, cf.path)
+}
+
+// Remove deletes config file of an additional account instance
+func (cf *Configs) Remove() error {
+	return os.Remove(cf.path)
+}
+
+// AccountInstances returns instance addresses of additional Mill accounts, found by their config files in data dir
+func AccountInstances(workDir string) []string {
+	files, err := filepath.Glob(filepath.Join(workDir, "data", "config_*.json"))
+	if err != nil {
+		return nil
+	}
+	instances := []string{}
+	for _, file := range files {
+		instance := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "config_"), ".json")
+		if _, err := strconv.Atoi(instance); err == nil {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		a, _ := strconv.Atoi(instances[i])
+		b, _ := strconv.Atoi(instances[j])
+		return a < b
+	})
+	return instances
+}
+
+func instanceFileName(name string, instance string) string {
+	if instance == "" || instance == "1" {
+		return name + ".json"
+	}
+	return name + "_" + instance + ".json"
 }
 
 func (cf *Configs) IsConfigured() bool {
@@ -119,9 +175,95 @@ func (cf *Configs) IsAuthenticated() bool {
 	}
 }
 
+// DefaultRemovalGrace is used when removal_grace_min is not set
+const DefaultRemovalGrace = 24 * time.Hour
+
+// RemovalGrace is how long a device can be missing from the Mill account before it is excluded from Futurehome
+func (cf *Configs) RemovalGrace() time.Duration {
+	minutes, err := strconv.Atoi(cf.RemovalGraceMin)
+	if err != nil || minutes < 0 {
+		return DefaultRemovalGrace
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// Defaults used when report_threshold or heartbeat_min are not set
+const (
+	DefaultTempThreshold = 0.2
+	DefaultHeartbeat     = time.Hour
+)
+
+// TempThreshold is how much a temperature has to change before the poller publishes it
+func (cf *Configs) TempThreshold() float64 {
+	threshold, err := strconv.ParseFloat(cf.ReportThreshold, 64)
+	if err != nil || threshold < 0 {
+		return DefaultTempThreshold
+	}
+	return threshold
+}
+
+// Heartbeat is how often the poller publishes reports that did not change
+func (cf *Configs) Heartbeat() time.Duration {
+	minutes, err := strconv.Atoi(cf.HeartbeatMin)
+	if err != nil || minutes < 1 {
+		return DefaultHeartbeat
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// DefaultOutageGrace is used when outage_grace_min is not set
+const DefaultOutageGrace = 30 * time.Minute
+
+// OutageGrace is how long Mill can be unreachable before devices are reported unavailable
+func (cf *Configs) OutageGrace() time.Duration {
+	minutes, err := strconv.Atoi(cf.OutageGraceMin)
+	if err != nil || minutes < 0 {
+		return DefaultOutageGrace
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// Poll time limits in minutes
+const (
+	MinPollTime = 1
+	MaxPollTime = 1440
+)
+
+// ParsePollTime validates poll time in minutes
+func ParsePollTime(val string) (int, error) {
+	minutes, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", val)
+	}
+	if minutes < MinPollTime || minutes > MaxPollTime {
+		return 0, fmt.Errorf("poll time %d must be between %d and %d minutes", minutes, MinPollTime, MaxPollTime)
+	}
+	return minutes, nil
+}
+
+// PollInterval is how often the poller polls the Mill account. Invalid poll_time_min polls every minute.
+func (cf *Configs) PollInterval() time.Duration {
+	minutes, err := ParsePollTime(cf.PollTimeMin)
+	if err != nil {
+		log.Error("Invalid poll time. Error: ", err)
+		minutes = MinPollTime
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// DevicePollInterval returns poll time override of the device
+func (cf *Configs) DevicePollInterval(deviceID string) (time.Duration, bool) {
+	minutes, ok := cf.DevicePollTime[deviceID]
+	if !ok || minutes < MinPollTime || minutes > MaxPollTime {
+		return 0, false
+	}
+	return time.Duration(minutes) * time.Minute, true
+}
+
 type ConfigReport struct {
-	OpStatus string    `json:"op_status"`
-	AppState AppStates `json:"app_state"`
+	OpStatus    string    `json:"op_status"`
+	AppState    AppStates `json:"app_state"`
+	PollTimeMin string    `json:"poll_time_min"`
 }
 
 func (cf *Configs) GetHubToken(oldMsg *fimpgo.Message) (*fimpgo.Address, *fimpgo.FimpMessage, error) {
@@ -0,0 +1,64 @@
+package model
+
+// Connectivity tells whether Mill can be used, and if not, why. It is derived from calls to Mill, see
+// account.connectivityMonitor.
+const (
+	ConnectivityUnknown       = ""
+	ConnectivityOK            = "OK"
+	ConnectivityNoInternet    = "NO_INTERNET"
+	ConnectivityMillDown      = "MILL_API_DOWN"
+	ConnectivityTokenRejected = "TOKEN_REJECTED"
+)
+
+// connectivityTexts describe connectivity in the manifest and in errors
+var connectivityTexts = map[string]string{
+	ConnectivityNoInternet:    "The hub has no internet connection",
+	ConnectivityMillDown:      "Mill API can't be reached",
+	ConnectivityTokenRejected: "Mill rejected the login, please log in again",
+}
+
+// SetConnectivity sets connection and auth states, and api and auth errors, from the outcome of the last call to
+// Mill. err is the error of the call, nil when connectivity is ConnectivityOK.
+func (al *Lifecycle) SetConnectivity(connectivity string, err error) {
+	// Set first, so state reports sent for the changes below carry the new connectivity. Every change of
+	// connectivity changes connection state or errors, so listeners are notified.
+	al.stateMux.Lock()
+	al.connectivity = connectivity
+	al.stateMux.Unlock()
+
+	switch connectivity {
+	case ConnectivityOK:
+		al.SetConnectionState(ConnStateConnected)
+		al.SetAuthState(AuthStateAuthenticated)
+		al.ClearError(ErrorSourceAPI)
+		al.ClearError(ErrorSourceAuth)
+	case ConnectivityTokenRejected:
+		// Mill answers, but can't be used until the user logs in again
+		al.SetConnectionState(ConnStateDisconnected)
+		al.SetAuthState(AuthStateNotAuthenticated)
+		al.ClearError(ErrorSourceAPI)
+		al.SetError(ErrorSourceAuth, ErrCodeNotLoggedIn, connectivityTexts[connectivity])
+	case ConnectivityNoInternet:
+		al.SetConnectionState(ConnStateDisconnected)
+		al.SetError(ErrorSourceAPI, ErrCodeNoInternet, connectivityTexts[connectivity])
+	case ConnectivityMillDown:
+		al.SetConnectionState(ConnStateDisconnected)
+		al.SetError(ErrorSourceAPI, ErrCodeMillUnreachable, connectivityTexts[connectivity]+": "+err.Error())
+	}
+}
+
+// Connectivity returns why Mill can or can't be used, ConnectivityUnknown before the first call
+func (al *Lifecycle) Connectivity() string {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
+	return al.connectivity
+}
+
+// ConnectionText describes the connection state for the manifest, with the reason when Mill can't be used
+func (al *Lifecycle) ConnectionText() string {
+	state, connectivity := al.ConnectionState(), al.Connectivity()
+	if text, ok := connectivityTexts[connectivity]; ok {
+		return string(state) + " (" + text + ")"
+	}
+	return string(state)
+}
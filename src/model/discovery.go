@@ -4,13 +4,14 @@ import (
 	"github.com/futurehomeno/fimpgo/discovery"
 )
 
-func GetDiscoveryResource() discovery.Resource {
+// GetDiscoveryResource returns the resource advertised for an adapter instance
+func GetDiscoveryResource(instance string) discovery.Resource {
 	return discovery.Resource{
 		ResourceName:           ServiceName,
 		ResourceType:           discovery.ResourceTypeAd,
 		Author:                 "your email",
-		IsInstanceConfigurable: false,
-		InstanceId:             "1",
+		IsInstanceConfigurable: true,
+		InstanceId:             instance,
 		Version:                "1",
 		AdapterInfo: discovery.AdapterInfo{
 			Technology:            "mill",
@@ -0,0 +1,29 @@
+package model
+
+import "errors"
+
+// ErrDeviceNotFound is returned when a deviceID is not in DeviceCollection
+var ErrDeviceNotFound = errors.New("device is not on the Mill account")
+
+// Error codes sent in evt.error.report
+const (
+	ErrCodeNotLoggedIn    = "NOT_LOGGED_IN"
+	ErrCodeDeviceNotFound = "DEVICE_NOT_FOUND"
+	ErrCodeWrongFormat    = "WRONG_FORMAT"
+	ErrCodeControlFailed  = "CONTROL_FAILED"
+	ErrCodeInternal       = "INTERNAL_ERROR"
+	ErrCodeFailed         = "FAILED"
+	// ErrCodeMillUnreachable and ErrCodeNoInternet are only used in app state, commands failing because Mill can't
+	// be reached are FAILED
+	ErrCodeMillUnreachable = "MILL_UNREACHABLE"
+	ErrCodeNoInternet      = "NO_INTERNET"
+)
+
+// ErrorReport is the value of evt.error.report, sent when a command fails. The report is correlated to the
+// command through corid, and also carries type and uid of the command.
+type ErrorReport struct {
+	ErrorCode   string `json:"error_code"`
+	ErrorText   string `json:"error_text"`
+	RequestType string `json:"request_type"`
+	RequestUID  string `json:"request_uid"`
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+)
+
+// Device status in evt.network.node_report
+const (
+	NodeStatusUp   = "UP"
+	NodeStatusDown = "DOWN"
+)
+
+// NodeReport tells if a device can be reached through Mill
+type NodeReport struct {
+	Address string `json:"address"`
+	Status  string `json:"status"`
+}
+
+// SetLists stores home, room and device lists fetched from Mill and ends an outage
+func (st *States) SetLists(hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}, now time.Time) {
+	st.HomeCollection, st.RoomCollection, st.DeviceCollection, st.IndependentDeviceCollection = hc, rc, dc, idc
+	st.LastUpdated = now.Unix()
+	st.OutageSince = 0
+}
+
+// ListsFailed records a failed update. Lists are kept, so devices are not lost when Mill can't be reached.
+func (st *States) ListsFailed(now time.Time) {
+	if st.OutageSince == 0 {
+		st.OutageSince = now.Unix()
+	}
+}
+
+// IsStale tells if the last update of the lists failed, so device values may be old
+func (st *States) IsStale() bool {
+	return st.OutageSince != 0
+}
+
+// OutageLasted tells if updates have failed for longer than d
+func (st *States) OutageLasted(d time.Duration, now time.Time) bool {
+	return st.IsStale() && now.Sub(time.Unix(st.OutageSince, 0)) >= d
+}
+
+// ReportProps adds "stale" and "last_updated" to props of reports with values from the lists
+func (st *States) ReportProps(props fimpgo.Props) fimpgo.Props {
+	if props == nil {
+		props = fimpgo.Props{}
+	}
+	props["stale"] = strconv.FormatBool(st.IsStale())
+	if st.LastUpdated != 0 {
+		props["last_updated"] = time.Unix(st.LastUpdated, 0).Format(time.RFC3339)
+	}
+	return props
+}
@@ -1,14 +1,18 @@
 package model
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 //
 // Events : STATING -> CONFIGURING -> CONFIGURED -> RUNNING
-// States : CONFIGURING -> RUNNING  / CONFIGURING -> NOT_CONFIGURED /
+// App states : STARTING -> NOT_CONFIGURED <-> RUNNING -> TERMINATING, see allowedTransitions
 
 const (
 	SystemEventTypeEvent = "EVENT"
@@ -46,13 +50,93 @@ const (
 
 type State string
 
+// State kinds, used as Name of state events and Kind of transitions
+const (
+	StateKindApp        = "app"
+	StateKindConfig     = "config"
+	StateKindAuth       = "auth"
+	StateKindConnection = "connection"
+	StateKindError      = "error"
+)
+
+// ErrInvalidTransition is returned when a state can't change to the requested state
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// transitionHistorySize is how many transitions Lifecycle keeps for state reports
+const transitionHistorySize = 20
+
+// allowedTransitions lists the states each state can change to, per state kind. Setting the current state again is
+// always allowed and does nothing.
+var allowedTransitions = map[string]map[State][]State{
+	StateKindApp: {
+		AppStateStarting:      {AppStateNotConfigured, AppStateRunning, AppStateStartupError, AppStateError, AppStateTerminate},
+		AppStateNotConfigured: {AppStateRunning, AppStateError, AppStateTerminate},
+		AppStateRunning:       {AppStateNotConfigured, AppStateError, AppStateTerminate},
+		AppStateError:         {AppStateRunning, AppStateNotConfigured, AppStateTerminate},
+		AppStateStartupError:  {AppStateTerminate},
+		AppStateTerminate:     {},
+	},
+	StateKindConfig: {
+		ConfigStateNA:             {ConfigStateNotConfigured, ConfigStateInProgress, ConfigStateConfigured, ConfigStatePartConfigured},
+		ConfigStateNotConfigured:  {ConfigStateInProgress, ConfigStateConfigured, ConfigStatePartConfigured},
+		ConfigStateInProgress:     {ConfigStateNotConfigured, ConfigStateConfigured, ConfigStatePartConfigured},
+		ConfigStateConfigured:     {ConfigStateNotConfigured, ConfigStateInProgress, ConfigStatePartConfigured},
+		ConfigStatePartConfigured: {ConfigStateNotConfigured, ConfigStateInProgress, ConfigStateConfigured},
+	},
+	StateKindAuth: {
+		AuthStateNA:               {AuthStateNotAuthenticated, AuthStateInProgress, AuthStateAuthenticated},
+		AuthStateNotAuthenticated: {AuthStateInProgress, AuthStateAuthenticated},
+		AuthStateInProgress:       {AuthStateNotAuthenticated, AuthStateAuthenticated},
+		AuthStateAuthenticated:    {AuthStateNotAuthenticated, AuthStateInProgress},
+	},
+	StateKindConnection: {
+		ConnStateNA:           {ConnStateConnecting, ConnStateConnected, ConnStateDisconnected},
+		ConnStateConnecting:   {ConnStateConnected, ConnStateDisconnected},
+		ConnStateConnected:    {ConnStateConnecting, ConnStateDisconnected},
+		ConnStateDisconnected: {ConnStateConnecting, ConnStateConnected},
+	},
+}
+
+// CanTransition returns whether a state of the given kind can change from one state to another
+func CanTransition(kind string, from State, to State) bool {
+	if from == to {
+		return true
+	}
+	for _, allowed := range allowedTransitions[kind][from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
 type AppStates struct {
-	App           string `json:"app"`
-	Connection    string `json:"connection"`
-	Config        string `json:"config"`
-	Auth          string `json:"auth"`
+	App        string `json:"app"`
+	Connection string `json:"connection"`
+	Config     string `json:"config"`
+	Auth       string `json:"auth"`
+	// Connectivity tells why Mill can't be used while connection is DISCONNECTED, see ConnectivityOK
+	Connectivity  string `json:"connectivity"`
 	LastErrorText string `json:"last_error_text"`
 	LastErrorCode string `json:"last_error_code"`
+	// LastErrorAt is when the last error occurred, RFC 3339, empty without errors
+	LastErrorAt string `json:"last_error_at"`
+	// Errors are all unresolved errors, latest first
+	Errors []AppError `json:"errors"`
+}
+
+// Transition is a change of app, config, auth or connection state
+type Transition struct {
+	Kind string    `json:"kind"`
+	From State     `json:"from"`
+	To   State     `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// AppStateReport is sent as evt.app.state_report whenever a state or the last error changes
+type AppStateReport struct {
+	AppStates
+	History []Transition `json:"history"`
 }
 
 type SystemEvent struct {
@@ -66,18 +150,20 @@ type SystemEvent struct {
 type SystemEventChannel chan SystemEvent
 
 type Lifecycle struct {
-	busMux           sync.Mutex
+	busMux sync.Mutex
+	// stateMux guards the states below, which are set by router and poller of an account
+	stateMux         sync.RWMutex
 	systemEventBus   map[string]SystemEventChannel
 	appState         State
 	previousAppState State
-	lastError        string
-	connectionState  State
-	authState        State
-	configState      State
-}
-
-func (al *Lifecycle) LastError() string {
-	return al.lastError
+	// appErrors are unresolved errors by source, see SetError
+	appErrors       map[string]AppError
+	connectionState State
+	// connectivity is why the connection state is what it is, see SetConnectivity
+	connectivity string
+	authState    State
+	configState  State
+	history      []Transition
 }
 
 func NewAppLifecycle() *Lifecycle {
@@ -90,59 +176,118 @@ func NewAppLifecycle() *Lifecycle {
 }
 
 func (al *Lifecycle) GetAllStates() *AppStates {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	appStates := AppStates{
-		App:           string(al.appState),
-		Connection:    string(al.connectionState),
-		Config:        string(al.configState),
-		Auth:          string(al.authState),
-		LastErrorText: "",
-		LastErrorCode: "",
+		App:          string(al.appState),
+		Connection:   string(al.connectionState),
+		Config:       string(al.configState),
+		Auth:         string(al.authState),
+		Connectivity: al.connectivity,
+		Errors:       al.sortedErrors(),
+	}
+	if len(appStates.Errors) > 0 {
+		last := appStates.Errors[0]
+		appStates.LastErrorText = last.Text
+		appStates.LastErrorCode = last.Code
+		appStates.LastErrorAt = last.At.Format(time.RFC3339)
 	}
 	return &appStates
 }
 
+// History returns the last transitions, oldest first
+func (al *Lifecycle) History() []Transition {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
+	history := make([]Transition, len(al.history))
+	copy(history, al.history)
+	return history
+}
+
+// StateReport returns current states with transition history
+func (al *Lifecycle) StateReport() AppStateReport {
+	return AppStateReport{AppStates: *al.GetAllStates(), History: al.History()}
+}
+
+// transition changes the state of kind held in current to target. Invalid transitions are logged and rejected.
+// Listeners get a state event when the state changed.
+func (al *Lifecycle) transition(kind string, current *State, target State, params map[string]string) error {
+	al.stateMux.Lock()
+	from := *current
+	if from == target {
+		al.stateMux.Unlock()
+		return nil
+	}
+	if !CanTransition(kind, from, target) {
+		al.stateMux.Unlock()
+		log.Warnf("<sysEvt> Rejected %s state change %s -> %s", kind, from, target)
+		return fmt.Errorf("%w: %s %s -> %s", ErrInvalidTransition, kind, from, target)
+	}
+	*current = target
+	if kind == StateKindApp {
+		al.previousAppState = from
+	}
+	al.history = append(al.history, Transition{Kind: kind, From: from, To: target, At: time.Now()})
+	if len(al.history) > transitionHistorySize {
+		al.history = al.history[len(al.history)-transitionHistorySize:]
+	}
+	al.stateMux.Unlock()
+	log.Debugf("<sysEvt> New %s state = %s", kind, target)
+	al.broadcastState(kind, target, params)
+	return nil
+}
+
+// broadcastState sends a state event to all listeners
+func (al *Lifecycle) broadcastState(kind string, state State, params map[string]string) {
+	al.busMux.Lock()
+	defer al.busMux.Unlock()
+	for i := range al.systemEventBus {
+		select {
+		case al.systemEventBus[i] <- SystemEvent{Type: SystemEventTypeState, Name: kind, State: state, Info: "sys", Params: params}:
+		default:
+			log.Warnf("<sysEvt> State listener %s is busy , event dropped", i)
+		}
+	}
+}
+
 func (al *Lifecycle) ConfigState() State {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	return al.configState
 }
 
-func (al *Lifecycle) SetConfigState(configState State) {
-	al.configState = configState
+func (al *Lifecycle) SetConfigState(configState State) error {
+	return al.transition(StateKindConfig, &al.configState, configState, nil)
 }
 
 func (al *Lifecycle) AuthState() State {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	return al.authState
 }
 
-func (al *Lifecycle) SetAuthState(authState State) {
-	al.authState = authState
+func (al *Lifecycle) SetAuthState(authState State) error {
+	return al.transition(StateKindAuth, &al.authState, authState, nil)
 }
 
 func (al *Lifecycle) ConnectionState() State {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	return al.connectionState
 }
 
-func (al *Lifecycle) SetConnectionState(connectivityState State) {
-	al.connectionState = connectivityState
+func (al *Lifecycle) SetConnectionState(connectivityState State) error {
+	return al.transition(StateKindConnection, &al.connectionState, connectivityState, nil)
 }
 
 func (al *Lifecycle) AppState() State {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	return al.appState
 }
 
-func (al *Lifecycle) SetAppState(currentState State, params map[string]string) {
-	al.busMux.Lock()
-	al.previousAppState = al.appState
-	al.appState = currentState
-	log.Debug("<sysEvt> New system state = ", currentState)
-	for i := range al.systemEventBus {
-		select {
-		case al.systemEventBus[i] <- SystemEvent{Type: SystemEventTypeState, State: currentState, Info: "sys", Params: params}:
-		default:
-			log.Warnf("<sysEvt> State listener %s is busy , event dropped", i)
-		}
-
-	}
-	al.busMux.Unlock()
+func (al *Lifecycle) SetAppState(currentState State, params map[string]string) error {
+	return al.transition(StateKindApp, &al.appState, currentState, params)
 }
 
 func (al *Lifecycle) PublishEvent(name, src string, params map[string]string) {
@@ -185,13 +330,14 @@ func (al *Lifecycle) processEvent(event SystemEvent) {
 	switch event.Name {
 
 	case EventConfiguring:
-		al.SetAppState(ConfigStateInProgress, nil)
+		al.SetConfigState(ConfigStateInProgress)
 
 	case EventConfigured:
-		al.SetAppState(ConfigStateConfigured, nil)
+		al.SetConfigState(ConfigStateConfigured)
 		al.SetAppState(AppStateRunning, nil)
 
 	case EventConfigError:
+		al.SetConfigState(ConfigStateNotConfigured)
 		al.SetAppState(AppStateNotConfigured, nil)
 	}
 
@@ -205,9 +351,28 @@ func (al *Lifecycle) WaitForState(subId string, targetState State) {
 	}
 	ch := al.Subscribe(subId, 5)
 	for evt := range ch {
-		if evt.Type == SystemEventTypeState && evt.State == targetState {
+		if evt.Type == SystemEventTypeState && evt.Name == StateKindApp && evt.State == targetState {
 			al.Unsubscribe(subId)
 			return
 		}
 	}
 }
+
+// WaitForStateContext blocks until target state is reached or ctx is done. Returns false if ctx is done first.
+func (al *Lifecycle) WaitForStateContext(ctx context.Context, subId string, targetState State) bool {
+	ch := al.Subscribe(subId, 5)
+	defer al.Unsubscribe(subId)
+	if al.AppState() == targetState {
+		return true
+	}
+	for {
+		select {
+		case evt := <-ch:
+			if evt.Type == SystemEventTypeState && evt.Name == StateKindApp && evt.State == targetState {
+				return true
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -8,7 +8,63 @@ import (
 	"github.com/futurehomeno/fimpgo/fimptype"
 )
 
+const (
+	DeviceTypeHeater = "heater"
+	DeviceTypeSensor = "sensor"
+	// DeviceTypeSocket is a Wi-Fi smart socket, only switched on and off
+	DeviceTypeSocket = "socket"
+	// DeviceTypeOilHeater is a heater with selectable power level in addition to setpoint
+	DeviceTypeOilHeater = "oil_heater"
+
+	// MinPowerLevel and MaxPowerLevel are the power levels of Mill oil heaters
+	MinPowerLevel = 1
+	MaxPowerLevel = 3
+)
+
+// AirQualityServices are services reported by Sense sensors in addition to sensor_temp, in the order they are reported
+var AirQualityServices = []string{"sensor_humid", "sensor_co2", "sensor_voc"}
+
 type NetworkService struct {
+	// InstanceAddress is the adapter instance of the Mill account the devices belong to, 1 if empty
+	InstanceAddress string
+	// RoomMapping maps Mill roomID to Futurehome room id, used as location hint in inclusion reports
+	RoomMapping map[string]string
+	// PowerLevel tells if the api backend can set power level of oil heaters
+	PowerLevel bool
+	// ModeControl tells if the api backend can turn heaters off
+	ModeControl bool
+	// LocalDevices maps Mill deviceID to the LAN address of devices with local control, which can always be turned off
+	LocalDevices map[string]string
+}
+
+// serviceAddress returns topic address of a device service, e.g. /rt:dev/rn:mill/ad:1/sv:thermostat/ad:123
+func (ns *NetworkService) serviceAddress(service string, serviceAddress string) string {
+	instance := ns.InstanceAddress
+	if instance == "" {
+		instance = "1"
+	}
+	return fmt.Sprintf("/rt:dev/rn:%s/ad:%s/sv:%s/ad:%s", ServiceName, instance, service, serviceAddress)
+}
+
+// SensorValue returns value and unit reported by sensor service of the device. ok is false if device has no such sensor.
+func SensorValue(device interface{}, service string) (value float32, unit string, ok bool) {
+	val := reflect.ValueOf(device)
+	switch service {
+	case "sensor_temp":
+		return val.FieldByName("CurrentTemp").Interface().(float32), "C", true
+	}
+	if val.FieldByName("DeviceType").String() != DeviceTypeSensor {
+		return 0, "", false
+	}
+	switch service {
+	case "sensor_humid":
+		return val.FieldByName("Humidity").Interface().(float32), "%", true
+	case "sensor_co2":
+		return val.FieldByName("Co2").Interface().(float32), "ppm", true
+	case "sensor_voc":
+		return val.FieldByName("Tvoc").Interface().(float32), "ppb", true
+	}
+	return 0, "", false
 }
 
 func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []interface{}) fimptype.ThingInclusionReport {
@@ -66,7 +122,6 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 	thermostatService := fimptype.Service{
 		Name:    "thermostat",
 		Alias:   "thermostat",
-		Address: "/rt:dev/rn:mill/ad:1/sv:thermostat/ad:",
 		Enabled: true,
 		Groups:  []string{"ch_0"},
 		Props: map[string]interface{}{
@@ -79,7 +134,6 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 	tempSensorService := fimptype.Service{
 		Name:    "sensor_temp",
 		Alias:   "Temperature sensor",
-		Address: "/rt:dev/rn:mill/ad:1/sv:sensor_temp/ad:",
 		Enabled: true,
 		Groups:  []string{"ch_0"},
 		Props: map[string]interface{}{
@@ -92,36 +146,193 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 
 	device := DeviceCollection[nodeId]
 	val := reflect.ValueOf(device)
-	deviceId = strconv.FormatInt(val.FieldByName("DeviceID").Interface().(int64), 10)
+	deviceId = val.FieldByName("DeviceID").String()
 	manufacturer = "mill"
 	name = val.FieldByName("DeviceName").Interface().(string)
-	serviceAddress := fmt.Sprintf("%s", deviceId)
-	thermostatService.Address = thermostatService.Address + serviceAddress
-	tempSensorService.Address = tempSensorService.Address + serviceAddress
-	services = append(services, thermostatService, tempSensorService)
+	serviceAddress := NewServiceAddress(ns.InstanceAddress, val.FieldByName("HomeID").String(), deviceId).String()
+
+	// Devices that can't have their setpoint changed only get a read-only thermostat
+	canSetTemperature := CanSetTemperature(int(val.FieldByName("CanChangeTemp").Int()), int(val.FieldByName("ControlType").Int()))
+	_, local := ns.LocalDevices[deviceId]
+	canSetMode := canSetTemperature && (ns.ModeControl || local)
+	if !canSetMode {
+		// Heating can't be turned off, the thermostat only reports mode heat
+		thermostatService.Props["sup_modes"] = []string{"heat"}
+	}
+	if !canSetTemperature || !canSetMode {
+		interfaces := []fimptype.Interface{}
+		for _, intf := range thermostatInterfaces {
+			if (intf.MsgType == "cmd.setpoint.set" && !canSetTemperature) || (intf.MsgType == "cmd.mode.set" && !canSetMode) {
+				continue
+			}
+			interfaces = append(interfaces, intf)
+		}
+		thermostatService.Interfaces = interfaces
+	}
+	thermostatService.Address = ns.serviceAddress("thermostat", serviceAddress)
+	tempSensorService.Address = ns.serviceAddress("sensor_temp", serviceAddress)
+	switch val.FieldByName("DeviceType").String() {
+	case DeviceTypeSensor:
+		// Sense sensors only measure, so they get no thermostat
+		services = append(services, tempSensorService,
+			ns.newSensorService("sensor_humid", "Humidity sensor", "%", serviceAddress),
+			ns.newSensorService("sensor_co2", "CO2 sensor", "ppm", serviceAddress),
+			ns.newSensorService("sensor_voc", "VOC sensor", "ppb", serviceAddress))
+	case DeviceTypeSocket:
+		services = append(services, ns.newBinarySwitchService(serviceAddress))
+	case DeviceTypeOilHeater:
+		services = append(services, thermostatService, tempSensorService)
+		if ns.PowerLevel {
+			services = append(services, ns.newLevelSwitchService(serviceAddress))
+		}
+	default:
+		services = append(services, thermostatService, tempSensorService)
+	}
 	deviceAddr = fmt.Sprintf("%s", deviceId)
 	powerSource := "ac"
 
+	subDomainID := int(val.FieldByName("SubDomainID").Int())
+	catalogEntry, _ := LookupCatalog(subDomainID)
+	modelName := val.FieldByName("ModelName").String()
+	if modelName == "" {
+		modelName = catalogEntry.ModelName
+	}
+	swVersion := "1"
+	if firmware := val.FieldByName("FirmwareVersion").String(); firmware != "" {
+		swVersion = firmware
+	}
+	techProps := map[string]string{
+		"model":         modelName,
+		"sub_domain_id": strconv.Itoa(subDomainID),
+	}
+	productType := val.FieldByName("ProductType").String()
+	if productType != "" {
+		techProps["product_type"] = productType
+	}
+	// Location hint, so devices can be placed in the same room as in the Mill app
+	if homeName := val.FieldByName("HomeName").String(); homeName != "" {
+		techProps["mill_home"] = homeName
+		techProps["mill_home_id"] = val.FieldByName("HomeID").String()
+	}
+	if roomID := val.FieldByName("RoomID").String(); roomID != "" {
+		roomName := val.FieldByName("RoomName").String()
+		techProps["mill_room"] = roomName
+		techProps["mill_room_id"] = roomID
+		techProps["location_hint"] = roomName
+		if fhRoom, ok := ns.RoomMapping[roomID]; ok && fhRoom != "" {
+			techProps["room"] = fhRoom
+		}
+	}
+
+	// Mac identifies the physical device, deviceId is only unique within the Mill account
+	productDeviceId := deviceId
+	if mac := val.FieldByName("Mac").String(); mac != "" {
+		techProps["mac"] = mac
+		productDeviceId = mac
+	}
+
 	inclReport := fimptype.ThingInclusionReport{
 		IntegrationId:     "",
 		Address:           deviceAddr,
 		Type:              "",
-		ProductHash:       manufacturer,
+		ProductHash:       ProductHash(subDomainID, productType),
 		CommTechnology:    "wifi",
+		ProductId:         modelName,
 		ProductName:       name,
 		ManufacturerId:    manufacturer,
-		DeviceId:          deviceId,
+		DeviceId:          productDeviceId,
 		HwVersion:         "1",
-		SwVersion:         "1",
+		SwVersion:         swVersion,
 		PowerSource:       powerSource,
 		WakeUpInterval:    "-1",
 		Security:          "",
 		Tags:              nil,
 		Groups:            []string{"ch_0"},
 		PropSets:          nil,
-		TechSpecificProps: nil,
+		TechSpecificProps: techProps,
 		Services:          services,
 	}
 
 	return inclReport
 }
+
+func (ns *NetworkService) newSensorService(name string, alias string, unit string, serviceAddress string) fimptype.Service {
+	return fimptype.Service{
+		Name:    name,
+		Alias:   alias,
+		Address: ns.serviceAddress(name, serviceAddress),
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"sup_units": []string{unit},
+		},
+		Interfaces: []fimptype.Interface{{
+			Type:      "in",
+			MsgType:   "cmd.sensor.get_report",
+			ValueType: "null",
+			Version:   "1",
+		}, {
+			Type:      "out",
+			MsgType:   "evt.sensor.report",
+			ValueType: "float",
+			Version:   "1",
+		}},
+	}
+}
+
+func (ns *NetworkService) newBinarySwitchService(serviceAddress string) fimptype.Service {
+	return fimptype.Service{
+		Name:    "out_bin_switch",
+		Alias:   "Switch",
+		Address: ns.serviceAddress("out_bin_switch", serviceAddress),
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props:   map[string]interface{}{},
+		Interfaces: []fimptype.Interface{{
+			Type:      "in",
+			MsgType:   "cmd.binary.set",
+			ValueType: "bool",
+			Version:   "1",
+		}, {
+			Type:      "in",
+			MsgType:   "cmd.binary.get_report",
+			ValueType: "null",
+			Version:   "1",
+		}, {
+			Type:      "out",
+			MsgType:   "evt.binary.report",
+			ValueType: "bool",
+			Version:   "1",
+		}},
+	}
+}
+
+func (ns *NetworkService) newLevelSwitchService(serviceAddress string) fimptype.Service {
+	return fimptype.Service{
+		Name:    "out_lvl_switch",
+		Alias:   "Power level",
+		Address: ns.serviceAddress("out_lvl_switch", serviceAddress),
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"min_lvl": MinPowerLevel,
+			"max_lvl": MaxPowerLevel,
+		},
+		Interfaces: []fimptype.Interface{{
+			Type:      "in",
+			MsgType:   "cmd.lvl.set",
+			ValueType: "int",
+			Version:   "1",
+		}, {
+			Type:      "in",
+			MsgType:   "cmd.lvl.get_report",
+			ValueType: "null",
+			Version:   "1",
+		}, {
+			Type:      "out",
+			MsgType:   "evt.lvl.report",
+			ValueType: "int",
+			Version:   "1",
+		}},
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
-	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -27,11 +27,39 @@ type States struct {
 	RoomCollection              []interface{}
 	DeviceCollection            []interface{}
 	IndependentDeviceCollection []interface{}
+
+	// LocalDevices maps Mill deviceID to the LAN address of Gen 3 heaters with local api enabled
+	LocalDevices map[string]string `json:"local_devices"`
+
+	// ExcludedDevices are Mill deviceIDs the user has deleted from Futurehome. They are not included again by sync.
+	ExcludedDevices []string `json:"excluded_devices"`
+
+	// Topology is the set of devices last seen on the Mill account, keyed by deviceID
+	Topology map[string]TopologyRecord `json:"topology"`
+
+	// AddressScheme is the service address format things were last announced with, 0 for adapters older than scheme 2
+	AddressScheme int `json:"address_scheme"`
+
+	// LastUpdated is unix time of the last successful update of the lists
+	LastUpdated int64 `json:"last_updated"`
+	// OutageSince is unix time of the first failed update since the last successful one, 0 if the last update succeeded
+	OutageSince int64 `json:"outage_since"`
+
+	// pending are commands waiting for read-back confirmation, keyed by deviceID and service
+	pending map[string]PendingCommand
+	// commandAt is when the last command was sent to each device
+	commandAt   map[string]time.Time
+	commandsMux sync.Mutex
 }
 
 func NewStates(workDir string) *States {
+	return NewInstanceStates(workDir, "1")
+}
+
+// NewInstanceStates loads state of an adapter instance, see NewInstanceConfigs
+func NewInstanceStates(workDir string, instance string) *States {
 	state := &States{WorkDir: workDir}
-	state.path = filepath.Join(workDir, "data", "state.json")
+	state.path = filepath.Join(workDir, "data", instanceFileName("state", instance))
 	if !utils.FileExists(state.path) {
 		log.Info("State file doesn't exist.Loading default state")
 		defaultStateFile := filepath.Join(workDir, "defaults", "state.json")
@@ -76,11 +104,15 @@ func (st *States) GetDefaultDir() string {
 }
 
 func (st *States) LoadDefaults() error {
-	stateFile := filepath.Join(st.WorkDir, "data", "state.json")
-	os.Remove(stateFile)
+	os.Remove(st.path)
 	log.Info("State file doesn't exist.Loading default state")
 	defaultStateFile := filepath.Join(st.WorkDir, "defaults", "state.json")
-	return utils.CopyFile(defaultStateFile, stateFile)
+	return utils.CopyFile(defaultStateFile, st.path)
+}
+
+// Remove deletes state file of an additional account instance
+func (st *States) Remove() error {
+	return os.Remove(st.path)
 }
 
 func (st *States) IsConfigured() bool {
@@ -97,26 +129,132 @@ type StateReport struct {
 	AppState AppStates `json:"app_state"`
 }
 
+// FindDeviceFromDeviceID returns index of the device in DeviceCollection. Independent devices are in
+// DeviceCollection as well, so the index is always valid for DeviceCollection.
 func (st *States) FindDeviceFromDeviceID(addr string) (index int, err error) {
-	// cf.LoadFromFile()
-
 	for i := 0; i < len(st.DeviceCollection); i++ {
 		val := reflect.ValueOf(st.DeviceCollection[i])
-		deviceId := strconv.FormatInt(val.FieldByName("DeviceID").Interface().(int64), 10)
-		if deviceId == addr {
-			index = i
-			return index, nil
+		if val.Kind() != reflect.Struct {
+			// Collections loaded from state.json are not typed until the next poll
+			continue
+		}
+		if val.FieldByName("DeviceID").String() == addr {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%w: %s", ErrDeviceNotFound, addr)
+}
+
+// LocalAddress returns LAN address of the device if it is configured for local control
+func (st *States) LocalAddress(deviceID string) (string, bool) {
+	address, ok := st.LocalDevices[deviceID]
+	if !ok || address == "" {
+		return "", false
+	}
+	return address, true
+}
+
+// SetLocalAddress configures LAN address of the device. Empty address removes local control.
+func (st *States) SetLocalAddress(deviceID string, address string) {
+	if address == "" {
+		delete(st.LocalDevices, deviceID)
+		return
+	}
+	if st.LocalDevices == nil {
+		st.LocalDevices = make(map[string]string)
+	}
+	st.LocalDevices[deviceID] = address
+}
+
+// IsExcluded tells if user has deleted the device from Futurehome
+func (st *States) IsExcluded(deviceID string) bool {
+	for _, excluded := range st.ExcludedDevices {
+		if excluded == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// Exclude adds device to the exclusion list
+func (st *States) Exclude(deviceID string) {
+	if !st.IsExcluded(deviceID) {
+		st.ExcludedDevices = append(st.ExcludedDevices, deviceID)
+	}
+}
+
+// Reinclude removes device from the exclusion list. Returns false if device was not excluded.
+func (st *States) Reinclude(deviceID string) bool {
+	for i, excluded := range st.ExcludedDevices {
+		if excluded == deviceID {
+			st.ExcludedDevices = append(st.ExcludedDevices[:i], st.ExcludedDevices[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceAddress returns service address of a device in DeviceCollection or Topology
+func (st *States) ServiceAddress(instance string, deviceID string) string {
+	homeID := st.Topology[deviceID].HomeID
+	for i := range st.DeviceCollection {
+		val := reflect.ValueOf(st.DeviceCollection[i])
+		if val.FieldByName("DeviceID").String() == deviceID {
+			homeID = val.FieldByName("HomeID").String()
+			break
+		}
+	}
+	return NewServiceAddress(instance, homeID, deviceID).String()
+}
+
+// NeedsAddressMigration tells if things were announced with an older service address scheme
+func (st *States) NeedsAddressMigration() bool {
+	return st.AddressScheme < AddressScheme
+}
+
+// DeviceID returns Mill deviceID of a device from DeviceCollection
+func DeviceID(device interface{}) string {
+	return reflect.ValueOf(device).FieldByName("DeviceID").String()
+}
+
+// IsHeating tells if a heater from DeviceCollection is heating right now
+func IsHeating(device interface{}) bool {
+	val := reflect.ValueOf(device)
+	if val.Kind() != reflect.Struct {
+		return false
+	}
+	return val.FieldByName("HeaterFlag").Int() == 1
+}
+
+// FilterHomes removes devices that are not in one of the given homes. HomeCollection is kept, so all homes on
+// the account can still be listed. Empty homeIDs means all homes are managed by this hub.
+func (st *States) FilterHomes(homeIDs []string) {
+	if len(homeIDs) == 0 {
+		return
+	}
+	st.DeviceCollection = filterByHome(st.DeviceCollection, homeIDs)
+	st.IndependentDeviceCollection = filterByHome(st.IndependentDeviceCollection, homeIDs)
+}
+
+func filterByHome(devices []interface{}, homeIDs []string) []interface{} {
+	filtered := []interface{}{}
+	for i := range devices {
+		if HomeSelected(reflect.ValueOf(devices[i]).FieldByName("HomeID").String(), homeIDs) {
+			filtered = append(filtered, devices[i])
 		}
 	}
-	for i := 0; i < len(st.IndependentDeviceCollection); i++ {
-		val := reflect.ValueOf(st.IndependentDeviceCollection[i])
-		deviceId := strconv.FormatInt(val.FieldByName("DeviceID").Interface().(int64), 10)
-		if deviceId == addr {
-			index = i
-			return index, nil
+	return filtered
+}
+
+// HomeSelected tells if home is managed by this hub
+func HomeSelected(homeID string, homeIDs []string) bool {
+	if len(homeIDs) == 0 {
+		return true
+	}
+	for _, selected := range homeIDs {
+		if selected == homeID {
+			return true
 		}
 	}
-	index = 9999 // using err did not work
-	log.Debug(err)
-	return index, err
+	return false
 }
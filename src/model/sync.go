@@ -0,0 +1,37 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SyncResult is the outcome of cmd.system.sync, listed by deviceID
+type SyncResult struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Unchanged []string `json:"unchanged"`
+	Failed    []string `json:"failed"`
+	Error     string   `json:"error"`
+	SyncedAt  string   `json:"synced_at"`
+}
+
+// Summary is a short text for the playground UI, e.g. "3 new devices found"
+func (sr *SyncResult) Summary() string {
+	if sr.Error != "" {
+		return sr.Error
+	}
+	if len(sr.Added) == 0 && len(sr.Removed) == 0 && len(sr.Failed) == 0 {
+		return fmt.Sprintf("No changes, %d devices up to date", len(sr.Unchanged))
+	}
+	parts := []string{}
+	if len(sr.Added) > 0 {
+		parts = append(parts, fmt.Sprintf("%d new devices found", len(sr.Added)))
+	}
+	if len(sr.Removed) > 0 {
+		parts = append(parts, fmt.Sprintf("%d devices removed", len(sr.Removed)))
+	}
+	if len(sr.Failed) > 0 {
+		parts = append(parts, fmt.Sprintf("%d devices failed", len(sr.Failed)))
+	}
+	return strings.Join(parts, ", ")
+}
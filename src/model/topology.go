@@ -0,0 +1,85 @@
+package model
+
+import (
+	"reflect"
+	"time"
+)
+
+// TopologyRecord is what the adapter last announced to Futurehome for a device
+type TopologyRecord struct {
+	Name   string `json:"name"`
+	HomeID string `json:"home_id"`
+	RoomID string `json:"room_id"`
+	// MissingSince is unix time of the first poll the device was not found in, 0 if device is present
+	MissingSince int64 `json:"missing_since"`
+}
+
+// TopologyChanges is the difference between fetched devices and stored topology
+type TopologyChanges struct {
+	// Added and Changed are indexes in DeviceCollection
+	Added   []int
+	Changed []int
+	// Removed are deviceIDs missing for longer than the grace period
+	Removed []string
+}
+
+// ReconcileTopology compares DeviceCollection with stored topology and updates the stored topology.
+// Devices missing from DeviceCollection are only reported as removed after grace period, so a short
+// outage or a failed poll does not remove devices from Futurehome.
+func (st *States) ReconcileTopology(now time.Time, grace time.Duration) TopologyChanges {
+	changes := TopologyChanges{}
+	if st.Topology == nil {
+		st.Topology = make(map[string]TopologyRecord)
+	}
+	seen := make(map[string]bool)
+	for i := range st.DeviceCollection {
+		val := reflect.ValueOf(st.DeviceCollection[i])
+		deviceID := val.FieldByName("DeviceID").String()
+		if seen[deviceID] {
+			// Independent devices are listed once per home query, only handle first occurrence
+			continue
+		}
+		seen[deviceID] = true
+		record := TopologyRecord{
+			Name:   val.FieldByName("DeviceName").String(),
+			HomeID: val.FieldByName("HomeID").String(),
+			RoomID: val.FieldByName("RoomID").String(),
+		}
+		old, ok := st.Topology[deviceID]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, i)
+		case old.Name != record.Name || old.RoomID != record.RoomID:
+			changes.Changed = append(changes.Changed, i)
+		}
+		st.Topology[deviceID] = record
+	}
+	for deviceID, record := range st.Topology {
+		if seen[deviceID] {
+			continue
+		}
+		if record.MissingSince == 0 {
+			record.MissingSince = now.Unix()
+			st.Topology[deviceID] = record
+			continue
+		}
+		if now.Sub(time.Unix(record.MissingSince, 0)) >= grace {
+			changes.Removed = append(changes.Removed, deviceID)
+			delete(st.Topology, deviceID)
+		}
+	}
+	return changes
+}
+
+// RemoveUnselectedHomes drops devices in homes no longer managed by this hub from topology and returns their
+// deviceIDs, so they can be excluded right away instead of after the removal grace period.
+func (st *States) RemoveUnselectedHomes(homeIDs []string) []string {
+	removed := []string{}
+	for deviceID, record := range st.Topology {
+		if !HomeSelected(record.HomeID, homeIDs) {
+			removed = append(removed, deviceID)
+			delete(st.Topology, deviceID)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+// testDevice has the fields ReconcileTopology reads from Mill devices
+type testDevice struct {
+	DeviceID   string
+	DeviceName string
+	HomeID     string
+	RoomID     string
+}
+
+func TestReconcileTopologyGrace(t *testing.T) {
+	pollInterval, grace := 5*time.Minute, 20*time.Minute
+	heater, socket := testDevice{DeviceID: "d1", DeviceName: "Heater", HomeID: "h1", RoomID: "r1"}, testDevice{DeviceID: "d2", DeviceName: "Socket", HomeID: "h1"}
+	st := &States{DeviceCollection: []interface{}{heater, socket}}
+	start := time.Now()
+	if changes := st.ReconcileTopology(start, grace); len(changes.Added) != 2 {
+		t.Fatalf("first poll added %v, expected both devices", changes.Added)
+	}
+
+	// Socket is missing from polls for less than the grace period, then shows up again
+	st.DeviceCollection = []interface{}{heater}
+	now := start
+	for now.Sub(start) < grace-pollInterval {
+		now = now.Add(pollInterval)
+		if changes := st.ReconcileTopology(now, grace); len(changes.Removed) != 0 {
+			t.Fatalf("%v after the first poll without it, socket was removed", now.Sub(start))
+		}
+	}
+	st.DeviceCollection = []interface{}{heater, socket}
+	now = now.Add(pollInterval)
+	if changes := st.ReconcileTopology(now, grace); len(changes.Added) != 0 || len(changes.Removed) != 0 {
+		t.Fatalf("socket that came back gave changes %+v, expected none", changes)
+	}
+	if st.Topology["d2"].MissingSince != 0 {
+		t.Error("socket that came back is still missing")
+	}
+
+	// Socket is missing again, it is removed once the grace period has passed
+	st.DeviceCollection = []interface{}{heater}
+	missing := now.Add(pollInterval)
+	removedAt := time.Duration(0)
+	for now = missing; now.Sub(missing) <= grace; now = now.Add(pollInterval) {
+		changes := st.ReconcileTopology(now, grace)
+		if len(changes.Removed) != 0 {
+			if len(changes.Removed) != 1 || changes.Removed[0] != "d2" {
+				t.Fatalf("removed %v, expected the socket", changes.Removed)
+			}
+			removedAt = now.Sub(missing)
+			break
+		}
+	}
+	if removedAt != grace {
+		t.Errorf("socket was removed %v after the first poll without it, expected %v", removedAt, grace)
+	}
+	if _, ok := st.Topology["d2"]; ok {
+		t.Error("removed socket is still in topology")
+	}
+	if _, ok := st.Topology["d1"]; !ok {
+		t.Error("heater was removed")
+	}
+}
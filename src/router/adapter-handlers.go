@@ -0,0 +1,703 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/millocal"
+	"github.com/thingsplex/mill/model"
+)
+
+// registerAdapterHandlers registers handlers for the adapter service and auth-api responses
+func (fc *FromFimpRouter) registerAdapterHandlers() {
+	fc.handlers.Handle(model.ServiceName, "cmd.auth.login", fc.handleLogin)
+	fc.handlers.Handle(model.ServiceName, "cmd.auth.set_tokens", fc.handleSetTokens)
+	fc.handlers.Handle(model.ServiceName, "cmd.auth.logout", fc.handleLogout)
+	fc.handlers.Handle(model.ServiceName, "cmd.network.get_all_nodes", fc.handleGetAllNodes, fc.requireLogin)
+	fc.handlers.Handle(model.ServiceName, "cmd.system.sync", fc.handleSync)
+	fc.handlers.Handle(model.ServiceName, "cmd.system.add_account", fc.handleAddAccount)
+	fc.handlers.Handle(model.ServiceName, "cmd.system.remove_account", fc.handleRemoveAccount)
+	fc.handlers.Handle(model.ServiceName, "cmd.system.get_accounts", fc.handleGetAccounts)
+	fc.handlers.Handle(model.ServiceName, "cmd.system.set_poll_time", fc.handleSetPollTime)
+	fc.handlers.Handle(model.ServiceName, "cmd.config.set_local_device", fc.handleSetLocalDevice)
+	fc.handlers.Handle(model.ServiceName, "cmd.config.get_local_devices", fc.handleGetLocalDevices)
+	fc.handlers.Handle(model.ServiceName, "cmd.app.get_manifest", fc.handleGetManifest)
+	fc.handlers.Handle(model.ServiceName, "cmd.app.get_state", fc.handleGetState)
+	fc.handlers.Handle(model.ServiceName, "cmd.config.get_extended_report", fc.handleGetExtendedReport)
+	fc.handlers.Handle(model.ServiceName, "cmd.config.extended_set", fc.handleExtendedSet)
+	fc.handlers.Handle(model.ServiceName, "cmd.log.set_level", fc.handleSetLogLevel)
+	fc.handlers.Handle(model.ServiceName, "cmd.system.reconnect", fc.handleReconnect)
+	fc.handlers.Handle(model.ServiceName, "cmd.app.factory_reset", fc.handleFactoryReset)
+	fc.handlers.Handle(model.ServiceName, "cmd.thing.get_inclusion_report", fc.handleGetInclusionReport)
+	fc.handlers.Handle(model.ServiceName, "cmd.thing.delete", fc.handleThingDelete)
+	fc.handlers.Handle(model.ServiceName, "cmd.thing.get_excluded_list", fc.handleGetExcludedList)
+	fc.handlers.Handle(model.ServiceName, "cmd.thing.reinclude", fc.handleReinclude)
+	fc.handlers.Handle(model.ServiceName, "cmd.app.uninstall", fc.handleUninstall)
+	fc.handlers.Handle("auth-api", "*", fc.handleAuthCode)
+}
+
+func (fc *FromFimpRouter) networkService() model.NetworkService {
+	backend := mill.NewBackend(fc.configs.ApiBackend)
+	return model.NetworkService{InstanceAddress: fc.instanceID, RoomMapping: fc.configs.RoomMapping, PowerLevel: backend.SupportsPowerLevel(),
+		ModeControl: backend.SupportsModeControl(), LocalDevices: fc.states.LocalDevices}
+}
+
+func (fc *FromFimpRouter) handleLogin(req *Request) error {
+	if !req.Backend.NeedsAuthCode() {
+		// Customer api logs in directly with username and password, no hub token or auth code needed
+		if err := req.Msg.Payload.GetObjectValue(fc.configs); err != nil {
+			return errWrongFormat
+		}
+		fc.configs.UID = req.Msg.Payload.UID
+		msg := fimpgo.NewMessage("cmd.auth.set_tokens", model.ServiceName, fimpgo.VTypeString, "", nil, nil, req.Msg.Payload)
+		newadr, err := fimpgo.NewAddressFromString(fc.adapterAddress("cmd"))
+		if err != nil {
+			return err
+		}
+		return fc.mqt.Publish(newadr, msg)
+	}
+	newadr, msg, err := fc.configs.GetHubToken(req.Msg)
+	fc.configs.UID = req.Msg.Payload.UID
+	if err != nil {
+		return fmt.Errorf("something went wrong when getting hub token: %w", err)
+	}
+	if msg == nil {
+		return errWrongFormat
+	}
+	// Every instance receives the reply of auth-api, only the instance that asked takes it
+	fc.hubTokenUID = msg.UID
+	return fc.mqt.Publish(newadr, msg)
+}
+
+func (fc *FromFimpRouter) handleSetTokens(req *Request) error {
+	var err error
+	if fc.configs.Auth.AuthorizationCode != "" || !req.Backend.NeedsAuthCode() {
+		authCode, password, username := fc.configs.Auth.AuthorizationCode, fc.configs.Password, fc.configs.Username
+		var accessToken, refreshToken string
+		var expireTime, refreshExpireTime int64
+		fc.unlocked(func() {
+			accessToken, refreshToken, expireTime, refreshExpireTime, err = req.Backend.Login(fc.ctx, authCode, password, username)
+		})
+		fc.configs.Auth.AccessToken, fc.configs.Auth.RefreshToken, fc.configs.Auth.ExpireTime, fc.configs.Auth.RefreshExpireTime = accessToken, refreshToken, expireTime, refreshExpireTime
+		if err != nil {
+			log.Error("<router> Login failed. Error: ", err)
+		}
+		fc.configs.Username = ""
+		fc.configs.Password = ""
+		fc.configs.SaveToFile()
+		fc.states.SaveToFile()
+	}
+
+	loginval := map[string]interface{}{
+		"errors":  nil,
+		"success": true,
+	}
+	if fc.configs.Auth.AccessToken != "" {
+		fc.appLifecycle.SetConfigState(model.ConfigStateConfigured)
+		fc.appLifecycle.SetAppState(model.AppStateRunning, nil)
+		// Mill accepted the login, so it can be used
+		fc.accounts.RecordMillResult(fc.instanceID, nil)
+		log.Debug("All tokens received and saved.")
+	} else {
+		fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
+		fc.appLifecycle.SetError(model.ErrorSourceAuth, model.ErrCodeNotLoggedIn, "Mill login failed, check username and password")
+		log.Debug("Login failed, please try again")
+		loginval["errors"] = "Wrong username or password"
+		loginval["success"] = false
+	}
+	newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:rsp/rt:cloud/rn:remote-client/ad:smarthome-app")
+	if err != nil {
+		log.Debug("Could not make login response topic")
+	}
+	msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, loginval, nil, nil, req.Msg.Payload)
+	msg.CorrelationID = fc.configs.UID
+	fc.mqt.Publish(newadr, msg)
+
+	msg = fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.GetAllStates(), nil, nil, req.Msg.Payload)
+	fc.reply(req, msg)
+
+	// Lists were fetched before login, so they are fetched again with the new token
+	listsErr := fc.updateLists(req.Backend)
+
+	msg = fimpgo.NewMessage("evt.network.get_all_nodes_report", model.ServiceName, fimpgo.VTypeObject, fc.states.DeviceCollection, nil, nil, req.Msg.Payload)
+	fc.reply(req, msg)
+	if listsErr != nil {
+		// Reconciling last good lists would start removal of devices that are still on the account.
+		// Devices are included by the poller once lists can be fetched.
+		return nil
+	}
+
+	// All devices are included below, so topology changes are only recorded
+	ns := fc.networkService()
+	fc.states.ReconcileTopology(time.Now(), fc.configs.RemovalGrace())
+	for i := 0; i < len(fc.states.DeviceCollection); i++ {
+		if fc.states.IsExcluded(model.DeviceID(fc.states.DeviceCollection[i])) {
+			continue
+		}
+		inclReport := ns.SendInclusionReport(i, fc.states.DeviceCollection)
+
+		msg := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
+		fc.mqt.Publish(fc.adapterEventAddress(), msg)
+	}
+	fc.states.AddressScheme = model.AddressScheme
+	fc.configs.SaveToFile()
+	fc.states.SaveToFile()
+	return nil
+}
+
+func (fc *FromFimpRouter) handleLogout(req *Request) error {
+	fc.configs.Auth.AccessToken = ""
+	fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
+	fc.appLifecycle.SetAppState(model.AppStateNotConfigured, nil)
+	fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
+	fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
+	// Errors of the old login don't apply anymore
+	fc.appLifecycle.ClearError(model.ErrorSourceAPI)
+	fc.appLifecycle.ClearError(model.ErrorSourceAuth)
+	fc.appLifecycle.ClearError(model.ErrorSourceControl)
+	for i := 0; i < len(fc.states.DeviceCollection); i++ {
+		val := map[string]interface{}{
+			"address": model.DeviceID(fc.states.DeviceCollection[i]),
+		}
+		msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.Msg.Payload)
+		fc.mqt.Publish(fc.adapterEventAddress(), msg)
+	}
+
+	fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
+	fc.states.ExcludedDevices = nil
+	fc.states.Topology = nil
+	fc.configs.LoadDefaults()
+	fc.states.LoadDefaults()
+
+	val2 := map[string]interface{}{
+		"errors":  nil,
+		"success": true,
+	}
+	msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, val2, nil, nil, req.Msg.Payload)
+	if err := fc.mqt.RespondToRequest(req.Msg.Payload, msg); err != nil {
+		log.Error("Could not respond to wanted request")
+	}
+	return nil
+}
+
+func (fc *FromFimpRouter) handleGetAllNodes(req *Request) error {
+	// Lists were updated before the message was handled, last good lists are reported if Mill can't be reached
+	report := []ListReportRecord{}
+	if len(fc.states.DeviceCollection) == 0 {
+		log.Debug("There are no devices")
+		return nil
+	}
+	for i := 0; i < len(fc.states.DeviceCollection); i++ {
+		device := reflect.ValueOf(fc.states.DeviceCollection[i])
+		deviceID := device.FieldByName("DeviceID").String()
+		name := device.FieldByName("DeviceName").Interface().(string)
+		rec := ListReportRecord{Address: deviceID, Alias: "Mill " + name, PowerSource: "ac", WakeupInterval: "-1"}
+		report = append(report, rec)
+	}
+
+	msg := fimpgo.NewMessage("evt.network.get_all_nodes_report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, req.Msg.Payload)
+	msg.Source = "mill"
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleSync(req *Request) error {
+	result := fc.syncDevices(req.Backend, req.Msg)
+	fc.configs.SyncStatus = result.Summary()
+	fc.configs.SaveToFile()
+	fc.states.SaveToFile()
+	log.Info("<router> Sync: ", fc.configs.SyncStatus)
+
+	val2 := map[string]interface{}{
+		"errors":  nil,
+		"success": true,
+		"summary": fc.configs.SyncStatus,
+		"result":  result,
+	}
+	if result.Error != "" {
+		val2["errors"] = result.Error
+		val2["success"] = false
+	}
+	msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, val2, nil, nil, req.Msg.Payload)
+	if err := fc.mqt.RespondToRequest(req.Msg.Payload, msg); err != nil {
+		log.Error("Could not respond to wanted request")
+	}
+	msg = fimpgo.NewMessage("evt.system.sync_report", model.ServiceName, fimpgo.VTypeObject, result, nil, nil, req.Msg.Payload)
+	return fc.mqt.Publish(fc.adapterEventAddress(), msg)
+}
+
+func (fc *FromFimpRouter) handleAddAccount(req *Request) error {
+	val := model.ButtonActionResponse{
+		Operation:       "cmd.system.add_account",
+		OperationStatus: "ok",
+		Next:            "config",
+		ErrorCode:       "",
+		ErrorText:       "",
+	}
+	instance, err := fc.accounts.AddAccount()
+	if err != nil {
+		log.Error("<router> Can't add account. Error: ", err)
+		val.OperationStatus = "error"
+		val.ErrorText = err.Error()
+	} else {
+		log.Info("<router> Added Mill account as adapter instance ", instance)
+	}
+	msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleRemoveAccount(req *Request) error {
+	// Removes the account served by this instance. Main instance can't be removed, log out instead.
+	val := model.ButtonActionResponse{
+		Operation:       "cmd.system.remove_account",
+		OperationStatus: "ok",
+		Next:            "config",
+		ErrorCode:       "",
+		ErrorText:       "",
+	}
+	if fc.instanceID == "1" {
+		val.OperationStatus = "error"
+		val.ErrorText = "Main account can't be removed, log out instead"
+		msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.Msg.Payload)
+		return fc.reply(req, msg)
+	}
+	for deviceID := range fc.states.Topology {
+		if fc.states.IsExcluded(deviceID) {
+			continue
+		}
+		val := map[string]interface{}{
+			"address": deviceID,
+		}
+		msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.Msg.Payload)
+		fc.mqt.Publish(fc.adapterEventAddress(), msg)
+	}
+	msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.Msg.Payload)
+	fc.reply(req, msg)
+	return fc.accounts.RemoveAccount(fc.instanceID)
+}
+
+func (fc *FromFimpRouter) handleGetAccounts(req *Request) error {
+	msg := fimpgo.NewMessage("evt.system.accounts_report", model.ServiceName, fimpgo.VTypeStrArray, fc.accounts.Accounts(), nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleSetPollTime(req *Request) error {
+	val, err := req.Msg.Payload.GetStringValue()
+	if err != nil {
+		minutes, intErr := req.Msg.Payload.GetIntValue()
+		if intErr != nil {
+			return errWrongFormat
+		}
+		val = strconv.FormatInt(minutes, 10)
+	}
+	if err := fc.setPollTime(val); err != nil {
+		return err
+	}
+	return fc.sendConfigReport(req)
+}
+
+// setPollTime saves a new poll time and applies it to the poller right away
+func (fc *FromFimpRouter) setPollTime(val string) error {
+	minutes, err := model.ParsePollTime(val)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errWrongFormat, err)
+	}
+	fc.configs.PollTimeMin = strconv.Itoa(minutes)
+	if err := fc.configs.SaveToFile(); err != nil {
+		return err
+	}
+	fc.accounts.Reschedule(fc.instanceID)
+	log.Info("<router> Poll time set to ", minutes, " minutes")
+	return nil
+}
+
+func (fc *FromFimpRouter) sendConfigReport(req *Request) error {
+	configReport := model.ConfigReport{
+		OpStatus:    "ok",
+		AppState:    *fc.appLifecycle.GetAllStates(),
+		PollTimeMin: fc.configs.PollTimeMin,
+	}
+	msg := fimpgo.NewMessage("evt.app.config_report", model.ServiceName, fimpgo.VTypeObject, configReport, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleSetLocalDevice(req *Request) error {
+	// Enables or disables local control of a Gen 3 heater. Empty ip removes local control.
+	val, err := req.Msg.Payload.GetStrMapValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	deviceID := val["address"]
+	if deviceID == "" {
+		return fmt.Errorf("%w: missing device address", errWrongFormat)
+	}
+	if ip := val["ip"]; ip != "" {
+		fc.unlocked(func() {
+			_, err = millocal.NewClient(ip).GetStatus()
+		})
+		if err != nil {
+			log.Warn("<router> Heater at ", ip, " does not respond to local api. Saving anyway. Error: ", err)
+		}
+	}
+	fc.states.SetLocalAddress(deviceID, val["ip"])
+	fc.states.SaveToFile()
+	if err := fc.handleGetLocalDevices(req); err != nil {
+		return err
+	}
+	// Mode control depends on local control, so the thing is included again with its current services
+	if err := fc.publishInclusionReport(deviceID); err != nil && !errors.Is(err, model.ErrDeviceNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (fc *FromFimpRouter) handleGetLocalDevices(req *Request) error {
+	msg := fimpgo.NewMessage("evt.config.local_devices_report", model.ServiceName, fimpgo.VTypeStrMap, fc.states.LocalDevices, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleGetManifest(req *Request) error {
+	mode, err := req.Msg.Payload.GetStringValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	manifest := model.NewManifest()
+	err = manifest.LoadFromFile(filepath.Join(fc.configs.GetDefaultDir(), "app-manifest.json"))
+	if err != nil {
+		return fmt.Errorf("failed to load manifest file: %w", err)
+	}
+	if mode == "manifest_state" {
+		manifest.AppState = *fc.appLifecycle.GetAllStates()
+		fc.configs.ConnectionState = fc.appLifecycle.ConnectionText()
+		fc.configs.Errors = fc.appLifecycle.LastError()
+		manifest.ConfigState = fc.configs
+	}
+	if errConf := manifest.GetAppConfig("errors"); errConf != nil {
+		if fc.configs.Errors == "" {
+			errConf.Hidden = true
+		} else {
+			errConf.Hidden = false
+		}
+	}
+
+	if homesConf := manifest.GetAppConfig("selected_homes"); homesConf != nil {
+		// Homes are listed from the Mill account, so the user can choose which homes this hub manages
+		options := []map[string]interface{}{}
+		for _, home := range fc.states.HomeCollection {
+			val := reflect.ValueOf(home)
+			options = append(options, map[string]interface{}{
+				"val":   val.FieldByName("HomeID").String(),
+				"label": model.MultilingualLabel{"en": val.FieldByName("HomeName").String()},
+			})
+		}
+		homesConf.UI.Select = options
+		homesConf.Hidden = len(options) < 2
+	}
+	if syncConf := manifest.GetAppConfig("sync_status"); syncConf != nil {
+		syncConf.Hidden = fc.configs.SyncStatus == ""
+	}
+	for i := range manifest.Services {
+		// Default manifest is written for the main instance
+		manifest.Services[i].Address = fmt.Sprintf("/rt:ad/rn:%s/ad:%s", model.ServiceName, fc.instanceID)
+	}
+	if removeButton := manifest.GetButton("remove_account"); removeButton != nil {
+		removeButton.Hidden = fc.instanceID == "1"
+	}
+
+	connectButton := manifest.GetButton("connect")
+	disconnectButton := manifest.GetButton("disconnect")
+	if connectButton != nil && disconnectButton != nil {
+		if fc.appLifecycle.ConnectionState() == model.ConnStateConnected {
+			connectButton.Hidden = true
+			disconnectButton.Hidden = false
+		} else {
+			connectButton.Hidden = false
+			disconnectButton.Hidden = true
+		}
+	}
+	if syncButton := manifest.GetButton("sync"); syncButton != nil {
+		if fc.appLifecycle.ConnectionState() == model.ConnStateConnected {
+			syncButton.Hidden = false
+		} else {
+			syncButton.Hidden = false
+		}
+	}
+	pollTimeBlock := manifest.GetUIBlock("poll_time_min")
+	if pollTimeBlock != nil {
+		pollTimeBlock.Hidden = false
+	}
+	settingsBlock := manifest.GetUIBlock("settings")
+	if settingsBlock != nil {
+		settingsBlock.Hidden = false
+	}
+	msg := fimpgo.NewMessage("evt.app.manifest_report", model.ServiceName, fimpgo.VTypeObject, manifest, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleGetState(req *Request) error {
+	// Answered with the same report that is published on every state change
+	msg := fimpgo.NewMessage("evt.app.state_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.StateReport(), nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleGetExtendedReport(req *Request) error {
+	msg := fimpgo.NewMessage("evt.config.extended_report", model.ServiceName, fimpgo.VTypeObject, fc.configs, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleExtendedSet(req *Request) error {
+	conf := model.Configs{}
+	err := req.Msg.Payload.GetObjectValue(&conf)
+	if err != nil {
+		return fmt.Errorf("%w: can't parse configuration object", errWrongFormat)
+	}
+	// Nothing is changed unless every field is valid
+	if err := validateExtendedSet(conf); err != nil {
+		return err
+	}
+	if conf.ApiBackend != "" && conf.ApiBackend != fc.configs.ApiBackend {
+		// Tokens from one backend are not valid for the other, so user has to log in again
+		log.Info("<router> Api backend changed to ", conf.ApiBackend, ". Login is required.")
+		fc.configs.ApiBackend = conf.ApiBackend
+		fc.configs.Auth.AccessToken = ""
+		fc.configs.Auth.ExpireTime = 0
+		fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
+	}
+	if conf.SelectedHomes != nil {
+		fc.configs.SelectedHomes = conf.SelectedHomes
+		// Devices in homes no longer managed by this hub are excluded right away
+		for _, deviceID := range fc.states.RemoveUnselectedHomes(fc.configs.SelectedHomes) {
+			val := map[string]interface{}{
+				"address": deviceID,
+			}
+			msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.Msg.Payload)
+			fc.mqt.Publish(fc.adapterEventAddress(), msg)
+		}
+		fc.states.FilterHomes(fc.configs.SelectedHomes)
+		fc.states.SaveToFile()
+	}
+	if conf.RoomMapping != nil {
+		fc.configs.RoomMapping = conf.RoomMapping
+	}
+	if conf.ReportThreshold != "" {
+		fc.configs.ReportThreshold = conf.ReportThreshold
+	}
+	if conf.OutageGraceMin != "" {
+		fc.configs.OutageGraceMin = conf.OutageGraceMin
+	}
+	if conf.HeartbeatMin != "" {
+		fc.configs.HeartbeatMin = conf.HeartbeatMin
+	}
+	if conf.DevicePollTime != nil {
+		fc.configs.DevicePollTime = conf.DevicePollTime
+		fc.accounts.Reschedule(fc.instanceID)
+	}
+	if conf.PollTimeMin != "" && conf.PollTimeMin != fc.configs.PollTimeMin {
+		// Saves all changes above
+		if err := fc.setPollTime(conf.PollTimeMin); err != nil {
+			return err
+		}
+	} else if err := fc.configs.SaveToFile(); err != nil {
+		return err
+	}
+	log.Debug("App reconfigured.")
+	return fc.sendConfigReport(req)
+}
+
+// validateExtendedSet checks every field set in cmd.config.extended_set
+func validateExtendedSet(conf model.Configs) error {
+	if conf.ApiBackend != "" && conf.ApiBackend != mill.BackendLegacy && conf.ApiBackend != mill.BackendCustomer {
+		return fmt.Errorf("%w: %q is not a supported api backend", errWrongFormat, conf.ApiBackend)
+	}
+	if conf.ReportThreshold != "" {
+		if threshold, err := strconv.ParseFloat(conf.ReportThreshold, 64); err != nil || threshold < 0 {
+			return fmt.Errorf("%w: %q is not a valid report threshold", errWrongFormat, conf.ReportThreshold)
+		}
+	}
+	if conf.OutageGraceMin != "" {
+		if minutes, err := strconv.Atoi(conf.OutageGraceMin); err != nil || minutes < 0 {
+			return fmt.Errorf("%w: %q is not a valid outage grace time", errWrongFormat, conf.OutageGraceMin)
+		}
+	}
+	if conf.HeartbeatMin != "" {
+		if minutes, err := strconv.Atoi(conf.HeartbeatMin); err != nil || minutes < 1 {
+			return fmt.Errorf("%w: %q is not a valid heartbeat interval", errWrongFormat, conf.HeartbeatMin)
+		}
+	}
+	for deviceID, minutes := range conf.DevicePollTime {
+		if _, err := model.ParsePollTime(strconv.Itoa(minutes)); err != nil {
+			return fmt.Errorf("%w: device %s: %v", errWrongFormat, deviceID, err)
+		}
+	}
+	if conf.PollTimeMin != "" {
+		if _, err := model.ParsePollTime(conf.PollTimeMin); err != nil {
+			return fmt.Errorf("%w: %v", errWrongFormat, err)
+		}
+	}
+	return nil
+}
+
+func (fc *FromFimpRouter) handleSetLogLevel(req *Request) error {
+	// Configure log level
+	level, err := req.Msg.Payload.GetStringValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	logLevel, err := log.ParseLevel(level)
+	if err == nil {
+		log.SetLevel(logLevel)
+		fc.configs.LogLevel = level
+		fc.configs.SaveToFile()
+		fc.states.SaveToFile()
+	}
+	log.Info("Log level updated to = ", logLevel)
+	return nil
+}
+
+func (fc *FromFimpRouter) handleReconnect(req *Request) error {
+	// This is optional operation. Without tokens there is nothing to reconnect to.
+	if fc.configs.IsConfigured() {
+		fc.appLifecycle.PublishEvent(model.EventConfigured, "from-fimp-router", nil)
+	}
+
+	val := model.ButtonActionResponse{
+		Operation:       "cmd.system.reconnect",
+		OperationStatus: "ok",
+		Next:            "config",
+		ErrorCode:       "",
+		ErrorText:       "",
+	}
+	msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleFactoryReset(req *Request) error {
+	val := model.ButtonActionResponse{
+		Operation:       "cmd.app.factory_reset",
+		OperationStatus: "ok",
+		Next:            "config",
+		ErrorCode:       "",
+		ErrorText:       "",
+	}
+	fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
+	fc.appLifecycle.SetAppState(model.AppStateNotConfigured, nil)
+	fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
+	msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleGetInclusionReport(req *Request) error {
+	deviceID, err := req.Msg.Payload.GetStringValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	return fc.publishInclusionReport(deviceID)
+}
+
+// publishInclusionReport includes the device again, unless it was deleted by the user
+func (fc *FromFimpRouter) publishInclusionReport(deviceID string) error {
+	nodeID, err := fc.states.FindDeviceFromDeviceID(deviceID)
+	if err != nil {
+		return err
+	}
+	if fc.states.IsExcluded(deviceID) {
+		return nil
+	}
+	ns := fc.networkService()
+	inclReport := ns.SendInclusionReport(nodeID, fc.states.DeviceCollection)
+
+	msg := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
+	return fc.mqt.Publish(fc.adapterEventAddress(), msg)
+}
+
+func (fc *FromFimpRouter) handleThingDelete(req *Request) error {
+	// remove device from network
+	val, err := req.Msg.Payload.GetStrMapValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	deviceID := val["address"]
+	if _, err := fc.states.FindDeviceFromDeviceID(deviceID); err != nil {
+		return err
+	}
+	exclVal := map[string]interface{}{
+		"address": deviceID,
+	}
+	msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, exclVal, nil, nil, req.Msg.Payload)
+	fc.mqt.Publish(fc.adapterEventAddress(), msg)
+	fc.states.Exclude(deviceID)
+	fc.states.SaveToFile()
+	log.Info("Device with deviceID: ", deviceID, " has been removed from network.")
+	return nil
+}
+
+func (fc *FromFimpRouter) handleGetExcludedList(req *Request) error {
+	report := []ListReportRecord{}
+	for _, deviceID := range fc.states.ExcludedDevices {
+		rec := ListReportRecord{Address: deviceID, PowerSource: "ac", WakeupInterval: "-1"}
+		if device, err := fc.findDevice(deviceID); err == nil {
+			rec.Alias = "Mill " + device.FieldByName("DeviceName").String()
+		}
+		report = append(report, rec)
+	}
+	msg := fimpgo.NewMessage("evt.thing.excluded_list_report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleReinclude(req *Request) error {
+	// Includes a single device previously deleted by the user
+	deviceID, err := req.Msg.Payload.GetStringValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	// Unknown devices are rejected before the exclusion list is changed
+	nodeID, err := fc.states.FindDeviceFromDeviceID(deviceID)
+	if err != nil {
+		return err
+	}
+	if !fc.states.Reinclude(deviceID) {
+		log.Info("<router> Device ", deviceID, " is not excluded")
+	}
+	fc.states.SaveToFile()
+	ns := fc.networkService()
+	inclReport := ns.SendInclusionReport(nodeID, fc.states.DeviceCollection)
+	msg := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, req.Msg.Payload)
+	fc.mqt.Publish(fc.adapterEventAddress(), msg)
+	log.Info("Device with deviceID: ", deviceID, " has been included again.")
+	return nil
+}
+
+func (fc *FromFimpRouter) handleUninstall(req *Request) error {
+	for i := 0; i < len(fc.states.DeviceCollection); i++ {
+		val := map[string]interface{}{
+			"address": model.DeviceID(fc.states.DeviceCollection[i]),
+		}
+		msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, req.Msg.Payload)
+		fc.mqt.Publish(fc.adapterEventAddress(), msg)
+	}
+	return nil
+}
+
+// handleAuthCode takes the hub token and authorization code requested by cmd.auth.login on the legacy api
+func (fc *FromFimpRouter) handleAuthCode(req *Request) error {
+	config := mill.Config{}
+	var authCode, hubToken string
+	fc.unlocked(func() {
+		authCode, hubToken = config.GetAuthCode(fc.ctx, req.Msg)
+	})
+	fc.configs.Auth.AuthorizationCode, fc.configs.HubToken = authCode, hubToken
+
+	msg := fimpgo.NewMessage("cmd.auth.set_tokens", model.ServiceName, fimpgo.VTypeString, "", nil, nil, req.Msg.Payload)
+	newadr, err := fimpgo.NewAddressFromString(fc.adapterAddress("cmd"))
+	if err != nil {
+		return err
+	}
+	return fc.mqt.Publish(newadr, msg)
+}
@@ -0,0 +1,164 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/millocal"
+	"github.com/thingsplex/mill/model"
+)
+
+// Mill cloud can take a few seconds to show a new value, so read-back is retried
+const readBackAttempts = 3
+
+// readBackDelay is the wait between read-back attempts, tests shorten it
+var readBackDelay = 5 * time.Second
+
+// readBackFunc reads the current value of the commanded service. ok is false if the device can't report the value.
+// A nil readBackFunc is used for devices known not to report the value, the command is unconfirmed right away.
+type readBackFunc func() (value string, ok bool, err error)
+
+// reportFunc publishes value of the commanded service, state is one of model.CommandState* or empty
+type reportFunc func(value string, state string) error
+
+// execute sends a command to Mill once and confirms it by reading the device back. A pending report is sent as soon
+// as Mill accepts the command, followed by the confirmed value, or an error report if the device shows another value.
+// control is called with the lock released, it must not use configs or states.
+func (fc *FromFimpRouter) execute(req *Request, cmd model.PendingCommand, control func() error, readBack readBackFunc, report reportFunc) error {
+	fc.states.SetPending(req.DeviceID, cmd)
+	var err error
+	fc.unlocked(func() {
+		err = control()
+	})
+	if err != nil {
+		fc.states.ClearPending(req.DeviceID, cmd)
+		return err
+	}
+	if err := report(cmd.Value, model.CommandStatePending); err != nil {
+		log.Error("<router> Can't send pending report. Error: ", err)
+	}
+	fc.running.Add(1)
+	go func() {
+		defer fc.running.Done()
+		fc.confirm(req, cmd, readBack, report)
+	}()
+	return nil
+}
+
+// confirm reads the device back until it shows the commanded value or attempts run out
+func (fc *FromFimpRouter) confirm(req *Request, cmd model.PendingCommand, readBack readBackFunc, report reportFunc) {
+	var actual string
+	known := false
+	for attempt := 0; attempt < readBackAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-fc.stopCh:
+				return
+			case <-time.After(readBackDelay):
+			}
+		}
+		if current, ok := fc.states.Pending(req.DeviceID, cmd.Service); !ok || !current.IssuedAt.Equal(cmd.IssuedAt) {
+			// A newer command on the same service is confirmed instead
+			return
+		}
+		if readBack == nil {
+			break
+		}
+		val, ok, err := readBack()
+		if err != nil {
+			log.Warn("<router> Can't read back ", cmd.Service, " of device ", req.DeviceID, ". Error: ", err)
+			continue
+		}
+		if !ok {
+			break
+		}
+		actual, known = val, true
+		if model.SameValue(actual, cmd.Value) {
+			break
+		}
+	}
+	if !fc.states.ClearPending(req.DeviceID, cmd) {
+		return
+	}
+
+	var err error
+	switch {
+	case !known:
+		log.Info("<router> Device ", req.DeviceID, " can't confirm ", cmd.Service, " ", cmd.Value)
+		err = report(cmd.Value, model.CommandStateUnconfirmed)
+	case model.SameValue(actual, cmd.Value):
+		err = report(actual, model.CommandStateConfirmed)
+	default:
+		err = report(actual, "")
+		controlErr := fmt.Errorf("%w: device %s shows %s %s, expected %s", errControlFailed, req.DeviceID, cmd.Service, actual, cmd.Value)
+		fc.sendErrorReport(req, controlErr)
+		fc.recordControlResult(req, controlErr)
+	}
+	if err != nil {
+		log.Error("<router> Can't send ", cmd.Service, " report. Error: ", err)
+	}
+}
+
+// recordControlResult records a failed command in app state, a command that succeeds clears the error
+func (fc *FromFimpRouter) recordControlResult(req *Request, err error) {
+	if err == nil {
+		fc.appLifecycle.ClearError(model.ErrorSourceControl)
+		return
+	}
+	fc.appLifecycle.SetError(model.ErrorSourceControl, errorCode(err), req.Msg.Payload.Type+" failed: "+err.Error())
+}
+
+// setpointReporter publishes evt.setpoint.report in response to req
+func (fc *FromFimpRouter) setpointReporter(req *Request) reportFunc {
+	return func(temp string, state string) error {
+		val := map[string]string{
+			"type": "heat",
+			"temp": temp,
+			"unit": "C",
+		}
+		var props fimpgo.Props
+		if state != "" {
+			props = fimpgo.Props{"state": state}
+		}
+		msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, val, props, nil, req.Msg.Payload)
+		return fc.reply(req, msg)
+	}
+}
+
+// localSetpoint reads setpoint from a heater with local api
+func localSetpoint(client *millocal.Client) readBackFunc {
+	return func() (string, bool, error) {
+		status, err := client.GetControlStatus()
+		if err != nil {
+			return "", false, err
+		}
+		return strconv.FormatFloat(float64(status.SetTemperature), 'f', -1, 32), true, nil
+	}
+}
+
+// cloudSetpoint reads setpoint of a single device from Mill, without changing the lists in states
+func (fc *FromFimpRouter) cloudSetpoint(backend mill.Backend, homeID string, roomID string, deviceID string) readBackFunc {
+	return func() (string, bool, error) {
+		fc.lock.Lock()
+		accessToken := fc.configs.Auth.AccessToken
+		fc.lock.Unlock()
+		fc.limiter.wait()
+		device, err := backend.ReadDevice(fc.ctx, accessToken, homeID, roomID, deviceID)
+		if errors.Is(err, model.ErrDeviceNotFound) {
+			// Mill answered, the device was moved or removed
+			fc.accounts.RecordMillResult(fc.instanceID, nil)
+			return "", false, err
+		}
+		fc.accounts.RecordMillResult(fc.instanceID, err)
+		if err != nil {
+			return "", false, err
+		}
+		return strconv.FormatFloat(float64(device.SetpointTemp), 'f', -1, 32), device.SetpointTemp != 0, nil
+	}
+}
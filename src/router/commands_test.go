@@ -0,0 +1,165 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/model"
+)
+
+// fakeBackend accepts or rejects setpoints and shows setpoints in turn when the device is read back, the last one
+// repeated. Other calls are not implemented.
+type fakeBackend struct {
+	mill.Backend
+	rejected  bool
+	setpoints []float32
+	readErr   error
+	reads     int
+}
+
+func (fb *fakeBackend) DeviceControl(ctx context.Context, accessToken string, deviceId string, newTemp string) bool {
+	return !fb.rejected
+}
+
+func (fb *fakeBackend) ReadDevice(ctx context.Context, accessToken string, homeID string, roomID string, deviceID string) (mill.Device, error) {
+	fb.reads++
+	if fb.readErr != nil {
+		return mill.Device{}, fb.readErr
+	}
+	setpoint := fb.setpoints[len(fb.setpoints)-1]
+	if fb.reads <= len(fb.setpoints) {
+		setpoint = fb.setpoints[fb.reads-1]
+	}
+	return mill.Device{DeviceID: mill.ID(deviceID), SetpointTemp: setpoint}, nil
+}
+
+// fakeAccounts ignores results of calls to Mill, other calls are not implemented
+type fakeAccounts struct {
+	AccountManager
+}
+
+func (fa fakeAccounts) RecordMillResult(instance string, err error) {}
+
+// newTestRouter returns a router on a transport that is never connected, so replies are dropped
+func newTestRouter(configs *model.Configs) *FromFimpRouter {
+	mqt := fimpgo.NewMqttTransport("tcp://localhost:1883", "mill-test", "", "", true, 1, 1)
+	return NewFromFimpRouter(mqt, model.NewAppLifecycle(), configs, &model.States{}, fakeAccounts{}, &sync.Mutex{})
+}
+
+// report is a report sent by execute
+type report struct {
+	value string
+	state string
+}
+
+func TestCommandIsConfirmedByReadBack(t *testing.T) {
+	defer func(delay time.Duration) { readBackDelay = delay }(readBackDelay)
+	readBackDelay = time.Millisecond
+	for name, test := range map[string]struct {
+		backend  *fakeBackend
+		noRead   bool
+		err      bool
+		reports  []report
+		reads    int
+		appError bool
+	}{
+		"confirmed":          {backend: &fakeBackend{setpoints: []float32{21.5}}, reports: []report{{"21.5", model.CommandStatePending}, {"21.5", model.CommandStateConfirmed}}, reads: 1},
+		"confirmed later":    {backend: &fakeBackend{setpoints: []float32{20, 20, 21.5}}, reports: []report{{"21.5", model.CommandStatePending}, {"21.5", model.CommandStateConfirmed}}, reads: 3},
+		"mismatch":           {backend: &fakeBackend{setpoints: []float32{20}}, reports: []report{{"21.5", model.CommandStatePending}, {"20", ""}}, reads: readBackAttempts, appError: true},
+		"setpoint not shown": {backend: &fakeBackend{setpoints: []float32{0}}, reports: []report{{"21.5", model.CommandStatePending}, {"21.5", model.CommandStateUnconfirmed}}, reads: 1},
+		"read fails":         {backend: &fakeBackend{readErr: errors.New("timeout")}, reports: []report{{"21.5", model.CommandStatePending}, {"21.5", model.CommandStateUnconfirmed}}, reads: readBackAttempts},
+		"not read back":      {backend: &fakeBackend{}, noRead: true, reports: []report{{"21.5", model.CommandStatePending}, {"21.5", model.CommandStateUnconfirmed}}},
+		"rejected by Mill":   {backend: &fakeBackend{rejected: true}, err: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fc := newTestRouter(&model.Configs{})
+			fc.limiter = newRateLimiter(0)
+			msg := fimpgo.NewMessage("cmd.setpoint.set", "thermostat", fimpgo.VTypeStrMap, map[string]string{"type": "heat", "temp": "21.5"}, nil, nil, nil)
+			req := &Request{Msg: &fimpgo.Message{Payload: msg, Addr: &fimpgo.Address{}}, Backend: test.backend, DeviceID: "d1"}
+			cmd := model.PendingCommand{Service: "thermostat", Value: "21.5", IssuedAt: time.Now()}
+			control := func() error {
+				if !req.Backend.DeviceControl(fc.ctx, "", req.DeviceID, cmd.Value) {
+					return errControlFailed
+				}
+				return nil
+			}
+			var readBack readBackFunc
+			if !test.noRead {
+				readBack = fc.cloudSetpoint(req.Backend, "h1", "r1", req.DeviceID)
+			}
+			var reportsMux sync.Mutex
+			reports := []report{}
+			reporter := func(value string, state string) error {
+				reportsMux.Lock()
+				defer reportsMux.Unlock()
+				reports = append(reports, report{value, state})
+				return nil
+			}
+
+			fc.lock.Lock()
+			err := fc.execute(req, cmd, control, readBack, reporter)
+			fc.lock.Unlock()
+			fc.running.Wait()
+			if (err != nil) != test.err {
+				t.Errorf("execute returned %v", err)
+			}
+			if len(test.reports) == 0 {
+				test.reports = []report{}
+			}
+			if !reflect.DeepEqual(reports, test.reports) {
+				t.Errorf("reported %v, expected %v", reports, test.reports)
+			}
+			if test.backend.reads != test.reads {
+				t.Errorf("device was read back %d times, expected %d", test.backend.reads, test.reads)
+			}
+			if _, pending := fc.states.Pending(req.DeviceID, "thermostat"); pending {
+				t.Error("command is still pending")
+			}
+			if appError := fc.appLifecycle.LastError() != ""; appError != test.appError {
+				t.Errorf("app error %q, expected an error %v", fc.appLifecycle.LastError(), test.appError)
+			}
+		})
+	}
+}
+
+func TestNewerCommandIsConfirmedInstead(t *testing.T) {
+	defer func(delay time.Duration) { readBackDelay = delay }(readBackDelay)
+	readBackDelay = 50 * time.Millisecond
+	fc := newTestRouter(&model.Configs{})
+	fc.limiter = newRateLimiter(0)
+	backend := &fakeBackend{setpoints: []float32{20}}
+	msg := fimpgo.NewMessage("cmd.setpoint.set", "thermostat", fimpgo.VTypeStrMap, map[string]string{"type": "heat", "temp": "21.5"}, nil, nil, nil)
+	req := &Request{Msg: &fimpgo.Message{Payload: msg, Addr: &fimpgo.Address{}}, Backend: backend, DeviceID: "d1"}
+	var reportsMux sync.Mutex
+	reports := []report{}
+	reporter := func(value string, state string) error {
+		reportsMux.Lock()
+		defer reportsMux.Unlock()
+		reports = append(reports, report{value, state})
+		return nil
+	}
+
+	fc.lock.Lock()
+	older := model.PendingCommand{Service: "thermostat", Value: "21.5", IssuedAt: time.Now()}
+	fc.execute(req, older, func() error { return nil }, fc.cloudSetpoint(backend, "h1", "r1", "d1"), reporter)
+	// Setpoint is changed again while the first command is read back
+	newer := model.PendingCommand{Service: "thermostat", Value: "22", IssuedAt: older.IssuedAt.Add(time.Second)}
+	fc.states.SetPending("d1", newer)
+	fc.lock.Unlock()
+	fc.running.Wait()
+
+	expected := []report{{"21.5", model.CommandStatePending}}
+	if !reflect.DeepEqual(reports, expected) {
+		t.Errorf("reported %v, expected only the pending report of the replaced command", reports)
+	}
+	if current, ok := fc.states.Pending("d1", "thermostat"); !ok || current.Value != "22" {
+		t.Error("newer command is not pending anymore")
+	}
+}
@@ -0,0 +1,255 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/thingsplex/mill/millocal"
+	"github.com/thingsplex/mill/model"
+)
+
+// registerDeviceHandlers registers handlers for services of Mill devices
+func (fc *FromFimpRouter) registerDeviceHandlers() {
+	fc.handleDevice("thermostat", "cmd.setpoint.set", fc.handleSetpointSet, fc.queued)
+	fc.handleDevice("thermostat", "cmd.setpoint.get_report", fc.handleSetpointGetReport)
+	fc.handleDevice("thermostat", "cmd.mode.set", fc.handleModeSet, fc.queued)
+	fc.handleDevice("thermostat", "cmd.mode.get_report", fc.handleModeGetReport)
+	fc.handleDevice("sensor_temp", "cmd.sensor.get_report", fc.handleTempGetReport)
+	fc.handleDevice("out_bin_switch", "cmd.binary.set", fc.handleBinarySet, fc.queued)
+	fc.handleDevice("out_bin_switch", "cmd.binary.get_report", fc.handleBinaryGetReport)
+	fc.handleDevice("out_lvl_switch", "cmd.lvl.set", fc.handleLvlSet, fc.queued)
+	fc.handleDevice("out_lvl_switch", "cmd.lvl.get_report", fc.handleLvlGetReport)
+	for _, service := range model.AirQualityServices {
+		fc.handleDevice(service, "cmd.sensor.get_report", fc.handleAirQualityGetReport)
+	}
+}
+
+// handleDevice registers a handler for a device service. Every device handler requires login and an addressed
+// device that exists, both are checked before the given middleware, so commands are never queued for unknown devices.
+func (fc *FromFimpRouter) handleDevice(service string, msgType string, handler HandlerFunc, middleware ...Middleware) {
+	fc.handlers.Handle(service, msgType, handler, append([]Middleware{fc.requireLogin, fc.withDevice}, middleware...)...)
+}
+
+func (fc *FromFimpRouter) handleSetpointSet(req *Request) error {
+	val, err := req.Msg.Payload.GetStrMapValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	if localAddr, ok := fc.states.LocalAddress(req.DeviceID); ok {
+		// Local api accepts decimals, so no rounding is needed. Falls back to cloud if heater is unreachable.
+		temp, err := strconv.ParseFloat(val["temp"], 32)
+		if err == nil {
+			client := millocal.NewClient(localAddr)
+			cmd := model.PendingCommand{Service: "thermostat", Value: strconv.FormatFloat(temp, 'f', -1, 32), IssuedAt: time.Now()}
+			control := func() error {
+				return client.SetTemperature(float32(temp))
+			}
+			err = fc.execute(req, cmd, control, localSetpoint(client), fc.setpointReporter(req))
+		}
+		if err == nil {
+			return nil
+		}
+		log.Warn("<router> Local control of device ", req.DeviceID, " failed, falling back to cloud. Error: ", err)
+	}
+	temp, err := strconv.ParseFloat(val["temp"], 32)
+	if err != nil {
+		return fmt.Errorf("%w: can't convert %q to temperature", errWrongFormat, val["temp"])
+	}
+	if !req.Backend.SupportsDecimalSetpoint() {
+		// Open api only takes whole degrees, so decimals are rounded up
+		temp = math.Ceil(temp)
+	}
+	newTemp := strconv.FormatFloat(temp, 'f', -1, 32)
+
+	cmd := model.PendingCommand{Service: "thermostat", Value: newTemp, IssuedAt: time.Now()}
+	accessToken := fc.configs.Auth.AccessToken
+	control := func() error {
+		if !req.Backend.DeviceControl(fc.ctx, accessToken, req.DeviceID, newTemp) {
+			return fmt.Errorf("%w: setpoint %s on device %s", errControlFailed, newTemp, req.DeviceID)
+		}
+		return nil
+	}
+	var readBack readBackFunc
+	if req.Device.FieldByName("SetpointTemp").Float() != 0 {
+		// Devices that don't report their setpoint are not read back, see handleSetpointGetReport
+		readBack = fc.cloudSetpoint(req.Backend, req.Device.FieldByName("HomeID").String(), req.Device.FieldByName("RoomID").String(), req.DeviceID)
+	}
+	return fc.execute(req, cmd, control, readBack, fc.setpointReporter(req))
+}
+
+func (fc *FromFimpRouter) handleSetpointGetReport(req *Request) error {
+	// You can ONLY get setpoint_report from devices that are independent(!). All devices have "holiday_temp" attribute, which for some reason is set temp on independent devices.
+	// Will always be 0 if it is not an independent device.
+	var setpointTemp string
+	if localAddr, ok := fc.states.LocalAddress(req.DeviceID); ok {
+		var status *millocal.ControlStatus
+		var err error
+		fc.unlocked(func() {
+			status, err = millocal.NewClient(localAddr).GetControlStatus()
+		})
+		if err == nil {
+			setpointTemp = strconv.FormatFloat(float64(status.SetTemperature), 'f', -1, 32)
+		} else {
+			log.Warn("<router> Can't read setpoint locally from device ", req.DeviceID, ", falling back to cloud. Error: ", err)
+		}
+	}
+	if setpointTemp == "" {
+		setpointTemp = strconv.FormatFloat(req.Device.FieldByName("SetpointTemp").Float(), 'f', -1, 32)
+	}
+
+	if cmd, ok := fc.states.Pending(req.DeviceID, "thermostat"); ok {
+		return fc.setpointReporter(req)(cmd.Value, model.CommandStatePending)
+	}
+	if setpointTemp == "0" {
+		return nil
+	}
+	return fc.setpointReporter(req)(setpointTemp, "")
+}
+
+func (fc *FromFimpRouter) handleModeSet(req *Request) error {
+	// Mode is changed on the heater when local api is enabled, otherwise through the cloud if the backend can do it
+	mode, err := req.Msg.Payload.GetStringValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	if localAddr, ok := fc.states.LocalAddress(req.DeviceID); ok {
+		localMode := millocal.OperationModeControlIndividually
+		if mode == "off" {
+			localMode = millocal.OperationModeOff
+		}
+		fc.unlocked(func() {
+			err = millocal.NewClient(localAddr).SetOperationMode(localMode)
+		})
+		if err != nil {
+			return fmt.Errorf("%w: can't set mode on device %s: %v", errControlFailed, req.DeviceID, err)
+		}
+	} else {
+		if !req.Backend.SupportsModeControl() {
+			return fmt.Errorf("%w: mode can only be changed on locally controlled devices", errControlFailed)
+		}
+		accessToken := fc.configs.Auth.AccessToken
+		var accepted bool
+		fc.unlocked(func() {
+			accepted = req.Backend.HeaterModeControl(fc.ctx, accessToken, req.DeviceID, mode != "off")
+		})
+		if !accepted {
+			return fmt.Errorf("%w: mode %s on device %s", errControlFailed, mode, req.DeviceID)
+		}
+	}
+	msg := fimpgo.NewMessage("evt.mode.report", "thermostat", fimpgo.VTypeString, mode, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleModeGetReport(req *Request) error {
+	val := "heat"
+	if localAddr, ok := fc.states.LocalAddress(req.DeviceID); ok {
+		var localMode string
+		var err error
+		fc.unlocked(func() {
+			localMode, err = millocal.NewClient(localAddr).GetOperationMode()
+		})
+		if err == nil && localMode == millocal.OperationModeOff {
+			val = "off"
+		}
+	} else if req.Backend.SupportsModeControl() && req.Device.FieldByName("PowerStatus").Int() == 0 {
+		val = "off"
+	}
+	msg := fimpgo.NewMessage("evt.mode.report", "thermostat", fimpgo.VTypeString, val, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleTempGetReport(req *Request) error {
+	var val float32
+	localOk := false
+	if localAddr, ok := fc.states.LocalAddress(req.DeviceID); ok {
+		var status *millocal.ControlStatus
+		var err error
+		fc.unlocked(func() {
+			status, err = millocal.NewClient(localAddr).GetControlStatus()
+		})
+		if err == nil {
+			val = status.AmbientTemperature
+			localOk = true
+		} else {
+			log.Warn("<router> Can't read temperature locally from device ", req.DeviceID, ", falling back to cloud. Error: ", err)
+		}
+	}
+	if !localOk {
+		val = req.Device.FieldByName("CurrentTemp").Interface().(float32)
+	}
+	props := fimpgo.Props{}
+	props["unit"] = "C"
+	if !localOk {
+		props = fc.states.ReportProps(props)
+	}
+
+	msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, val, props, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleBinarySet(req *Request) error {
+	on, err := req.Msg.Payload.GetBoolValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	accessToken := fc.configs.Auth.AccessToken
+	var accepted bool
+	fc.unlocked(func() {
+		accepted = req.Backend.SwitchControl(fc.ctx, accessToken, req.DeviceID, on)
+	})
+	if !accepted {
+		return fmt.Errorf("%w: switching device %s", errControlFailed, req.DeviceID)
+	}
+	msg := fimpgo.NewMessage("evt.binary.report", "out_bin_switch", fimpgo.VTypeBool, on, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleBinaryGetReport(req *Request) error {
+	msg := fimpgo.NewMessage("evt.binary.report", "out_bin_switch", fimpgo.VTypeBool, req.Device.FieldByName("PowerStatus").Int() == 1, fc.states.ReportProps(nil), nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleLvlSet(req *Request) error {
+	level, err := req.Msg.Payload.GetIntValue()
+	if err != nil {
+		return errWrongFormat
+	}
+	if level < model.MinPowerLevel || level > model.MaxPowerLevel {
+		return fmt.Errorf("%w: power level %d is out of range", errWrongFormat, level)
+	}
+	accessToken := fc.configs.Auth.AccessToken
+	var accepted bool
+	fc.unlocked(func() {
+		accepted = req.Backend.SetPowerLevel(fc.ctx, accessToken, req.DeviceID, int(level))
+	})
+	if !accepted {
+		return fmt.Errorf("%w: power level %d on device %s", errControlFailed, level, req.DeviceID)
+	}
+	msg := fimpgo.NewMessage("evt.lvl.report", "out_lvl_switch", fimpgo.VTypeInt, level, nil, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleLvlGetReport(req *Request) error {
+	msg := fimpgo.NewMessage("evt.lvl.report", "out_lvl_switch", fimpgo.VTypeInt, req.Device.FieldByName("PowerLevel").Int(), fc.states.ReportProps(nil), nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
+
+func (fc *FromFimpRouter) handleAirQualityGetReport(req *Request) error {
+	service := req.Msg.Payload.Service
+	val, unit, ok := model.SensorValue(req.Device.Interface(), service)
+	if !ok {
+		log.Debug("<router> Device ", req.DeviceID, " has no ", service)
+		return nil
+	}
+	props := fimpgo.Props{}
+	props["unit"] = unit
+	props = fc.states.ReportProps(props)
+
+	msg := fimpgo.NewMessage("evt.sensor.report", service, fimpgo.VTypeFloat, val, props, nil, req.Msg.Payload)
+	return fc.reply(req, msg)
+}
@@ -1,14 +1,11 @@
 package router
 
 import (
+	"context"
 	"fmt"
-	"path/filepath"
-	"reflect"
-	"strconv"
+	"sync"
 	"time"
 
-	"strings"
-
 	"github.com/futurehomeno/fimpgo"
 	log "github.com/sirupsen/logrus"
 
@@ -18,11 +15,50 @@ import (
 
 type FromFimpRouter struct {
 	inboundMsgCh fimpgo.MessageCh
+	stopCh       chan struct{}
+	// ctx is passed to calls to Mill, it is cancelled when Stop gives up waiting for them
+	ctx          context.Context
+	cancel       context.CancelFunc
 	mqt          *fimpgo.MqttTransport
 	instanceID   string
 	appLifecycle *model.Lifecycle
 	configs      *model.Configs
 	states       *model.States
+	// lock guards configs and states, which are shared with the poller of the account
+	lock     sync.Locker
+	accounts AccountManager
+	handlers *Registry
+	limiter  *rateLimiter
+	commands *commandQueue
+	// running counts goroutines that may call Mill, Stop waits for them
+	running sync.WaitGroup
+	// listsUpdatedAt is when device lists were last fetched with listsToken
+	listsUpdatedAt time.Time
+	listsToken     string
+	// hubTokenUID is the uid of the hub token request sent by login on this instance, auth-api correlates its reply
+	hubTokenUID string
+}
+
+const (
+	// listsMaxAge is how long device lists fetched for one message are reused for the following messages
+	listsMaxAge = 10 * time.Second
+	// stopTimeout is how long Stop waits for calls to Mill in progress before they are cancelled
+	stopTimeout = 10 * time.Second
+)
+
+// AccountManager adds and removes Mill accounts, each served by its own adapter instance
+type AccountManager interface {
+	// AddAccount creates a new account instance and returns its instance address
+	AddAccount() (string, error)
+	// RemoveAccount stops the account instance and deletes its config and state
+	RemoveAccount(instance string) error
+	// Accounts returns instance addresses of all accounts
+	Accounts() []string
+	// Reschedule makes the poller of the account instance apply a new poll time
+	Reschedule(instance string)
+	// RecordMillResult updates connection state of the account instance from the outcome of a call to Mill that
+	// needs the access token
+	RecordMillResult(instance string, err error)
 }
 
 type ListReportRecord struct {
@@ -32,9 +68,25 @@ type ListReportRecord struct {
 	PowerSource    string `json:"power_source"`
 }
 
-func NewFromFimpRouter(mqt *fimpgo.MqttTransport, appLifecycle *model.Lifecycle, configs *model.Configs, states *model.States) *FromFimpRouter {
-	fc := FromFimpRouter{inboundMsgCh: make(fimpgo.MessageCh, 5), mqt: mqt, appLifecycle: appLifecycle, configs: configs, states: states}
-	fc.mqt.RegisterChannel("ch1", fc.inboundMsgCh)
+// NewFromFimpRouter returns router of an account instance. lock must be held by everyone using configs and states.
+func NewFromFimpRouter(mqt *fimpgo.MqttTransport, appLifecycle *model.Lifecycle, configs *model.Configs, states *model.States, accounts AccountManager, lock sync.Locker) *FromFimpRouter {
+	fc := FromFimpRouter{inboundMsgCh: make(fimpgo.MessageCh, 5), stopCh: make(chan struct{}), mqt: mqt, instanceID: configs.InstanceAddress, appLifecycle: appLifecycle, configs: configs, states: states, lock: lock, accounts: accounts}
+	if fc.instanceID == "" {
+		fc.instanceID = "1"
+	}
+	fc.ctx, fc.cancel = context.WithCancel(context.Background())
+	fc.limiter = millLimiter
+	fc.commands = newCommandQueue(fc.limiter, fc.stopCh)
+	fc.handlers = NewRegistry()
+	fc.registerDeviceHandlers()
+	fc.registerAdapterHandlers()
+	// Every account instance has its own router, so each router only takes messages addressed to its instance
+	fc.mqt.RegisterChannelWithFilterFunc("ch"+fc.instanceID, fc.inboundMsgCh, func(topic string, addr *fimpgo.Address, iotMsg *fimpgo.FimpMessage) bool {
+		if addr.ResourceName == "auth-api" {
+			return true
+		}
+		return addr.ResourceName == model.ServiceName && addr.ResourceAddress == fc.instanceID
+	})
 	return &fc
 }
 
@@ -43,520 +95,221 @@ func (fc *FromFimpRouter) Start() {
 	// TODO: Choose either adapter or app topic
 
 	// ------ Adapter topics ---------------------------------------------
-	fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:dev/rn:%s/ad:1/#", model.ServiceName))
-	fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:ad/rn:%s/ad:1", model.ServiceName))
+	fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:dev/rn:%s/ad:%s/#", model.ServiceName, fc.instanceID))
+	fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:ad/rn:%s/ad:%s", model.ServiceName, fc.instanceID))
 	fc.mqt.Subscribe("pt:j1/mt:evt/rt:cloud/rn:auth-api/ad:1")
 
 	// ------ Application topic -------------------------------------------
 	//fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:app/rn:%s/ad:1",model.ServiceName))
 
+	stateCh := fc.appLifecycle.Subscribe("state-report", 20)
+	fc.running.Add(3)
+	go func() {
+		defer fc.running.Done()
+		fc.commands.run()
+	}()
+	go func() {
+		defer fc.running.Done()
+		fc.reportStates(stateCh)
+	}()
 	go func(msgChan fimpgo.MessageCh) {
+		defer fc.running.Done()
 		for {
 			select {
 			case newMsg := <-msgChan:
 				fc.routeFimpMessage(newMsg)
+			case <-fc.stopCh:
+				return
 			}
 		}
 	}(fc.inboundMsgCh)
 }
 
-func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
-	config := mill.Config{}
-	client := mill.Client{}
-	ns := model.NetworkService{}
-
-	if fc.configs.IsConfigured() {
-		fc.appLifecycle.SetConnectionState(model.ConnStateConnected)
-		fc.appLifecycle.SetConfigState(model.ConfigStateConfigured)
-	} else {
-		fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
-		fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
+// Stop unsubscribes instance topics and stops routing. Stop waits until the message being routed is completed,
+// queued commands are sent and read-backs in progress have returned, so no call to Mill is cut off. Calls still
+// in progress after stopTimeout are cancelled. Must not be called from a handler of the same router.
+func (fc *FromFimpRouter) Stop() {
+	fc.mqt.UnregisterChannel("ch" + fc.instanceID)
+	fc.mqt.Unsubscribe(fmt.Sprintf("pt:j1/+/rt:dev/rn:%s/ad:%s/#", model.ServiceName, fc.instanceID))
+	fc.mqt.Unsubscribe(fmt.Sprintf("pt:j1/+/rt:ad/rn:%s/ad:%s", model.ServiceName, fc.instanceID))
+	close(fc.stopCh)
+	done := make(chan struct{})
+	go func() {
+		fc.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		log.Warn("<router> Cancelling calls to Mill in progress on instance ", fc.instanceID)
+		fc.cancel()
+		<-done
 	}
+	fc.cancel()
+	log.Info("<router> Stopped router of instance ", fc.instanceID)
+}
 
-	// Get new tokens if expires_in is exceeded. expireTime lasts for two hours, refreshExpireTime lasts for 30 days.
-	if fc.configs.Auth.ExpireTime != 0 {
-		millis := time.Now().UnixNano() / 1000000
-		if millis > fc.configs.Auth.ExpireTime && millis < fc.configs.Auth.RefreshExpireTime {
-			var err error
-			accessToken, refreshToken, expireTime, refreshExpireTime, err := config.RefreshToken(fc.configs.Auth.RefreshToken)
-			if err == nil {
-				fc.configs.Auth.AccessToken = accessToken
-				fc.configs.Auth.RefreshToken = refreshToken
-				fc.configs.Auth.ExpireTime = expireTime
-				fc.configs.Auth.RefreshExpireTime = refreshExpireTime
-			} else {
-				fc.configs.Auth.ExpireTime = 1
-			}
-			fc.states.SaveToFile()
-		} else if millis > fc.configs.Auth.RefreshExpireTime {
-			log.Error("30 day refreshExpireTime has expired. Restard adapter or send cmd.auth.login")
+// reportStates publishes evt.app.state_report whenever a lifecycle state or the last error changes
+func (fc *FromFimpRouter) reportStates(stateCh model.SystemEventChannel) {
+	defer fc.appLifecycle.Unsubscribe("state-report")
+	for {
+		select {
+		case evt := <-stateCh:
+			if evt.Type != model.SystemEventTypeState {
+				continue
+			}
+			msg := fimpgo.NewMessage("evt.app.state_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.StateReport(), nil, nil, nil)
+			if err := fc.mqt.Publish(fc.adapterEventAddress(), msg); err != nil {
+				log.Error("<router> Can't send state report. Error: ", err)
+			}
+		case <-fc.stopCh:
+			return
 		}
 	}
+}
 
-	// Update home- room- and devicelists
-	fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-	fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection = client.UpdateLists(fc.configs.Auth.AccessToken, fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection)
-	fc.states.SaveToFile()
-	log.Debug(" ")
-	log.Debug("New fimp msg")
-	addr := strings.Replace(newMsg.Addr.ServiceAddress, "_0", "", 1)
-	switch newMsg.Payload.Service {
-	case "thermostat":
-		log.Debug("Service: thermostat")
-		addr = strings.Replace(addr, "l", "", 1)
-		switch newMsg.Payload.Type {
-		case "cmd.setpoint.set":
-			val, _ := newMsg.Payload.GetStrMapValue()
-			valTemp := strings.Split(val["temp"], ".")
-			newTempInt, err := strconv.Atoi(valTemp[0])
-			halfTemp, err := strconv.Atoi(valTemp[1])
-			if err != nil {
-				// handle err
-				log.Error(fmt.Errorf("Can't convert to string, error: ", err))
-			}
-			if halfTemp > 0 {
-				newTempInt++
-			}
-			newTemp := strconv.Itoa(newTempInt)
-			deviceID := addr
-
-			if config.DeviceControl(fc.configs.Auth.AccessToken, deviceID, newTemp) {
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: addr}
-				msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, val, nil, nil, newMsg.Payload)
-				fc.mqt.Publish(adr, msg)
-			}
-
-			if !config.DeviceControl(fc.configs.Auth.AccessToken, deviceID, newTemp) {
-				log.Error("something went wrong when changing temperature")
-			}
-
-		case "cmd.setpoint.get_report":
-			// You can ONLY get setpoint_report from devices that are independent(!). All devices have "holiday_temp" attribute, which for some reason is set temp on independent devices.
-			// Will always be 0 if it is not an independent device.
-			deviceIndex, err := fc.states.FindDeviceFromDeviceID(addr)
-			if err != nil {
-				log.Error(fmt.Errorf("Can't find device from deviceID, error: ", err))
-			}
-			device := reflect.ValueOf(fc.states.DeviceCollection[deviceIndex])
-			setpointTemp := strconv.FormatInt(device.FieldByName("SetpointTemp").Interface().(int64), 10)
-
-			if setpointTemp != "0" {
-				val := map[string]interface{}{
-					"type": "heat",
-					"temp": setpointTemp,
-					"unit": "C",
-				}
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: addr}
-				msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, val, nil, nil, newMsg.Payload)
-				fc.mqt.Publish(adr, msg)
-			}
-
-		case "cmd.mode.set":
-			// Do we need this? Will/should allways be heat
-
-		case "cmd.mode.get_report":
-			val := "heat"
+// adapterAddress returns address of this adapter instance in the given command topic format
+func (fc *FromFimpRouter) adapterAddress(msgType string) string {
+	return fmt.Sprintf("pt:j1/mt:%s/rt:ad/rn:%s/ad:%s", msgType, model.ServiceName, fc.instanceID)
+}
 
-			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: addr}
-			msg := fimpgo.NewMessage("evt.mode.report", "thermostat", fimpgo.VTypeString, val, nil, nil, newMsg.Payload)
-			fc.mqt.Publish(adr, msg)
+func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if newMsg.Payload.Service == "auth-api" {
+		if fc.hubTokenUID == "" || newMsg.Payload.CorrelationID != fc.hubTokenUID {
+			// Hub token was requested by login on another account instance
+			return
 		}
-
-	case "sensor_temp":
-		log.Debug("Service: sensor_temp")
-		addr = strings.Replace(addr, "l", "", 1)
-		switch newMsg.Payload.Type {
-		case "cmd.sensor.get_report":
-			deviceIndex, err := fc.states.FindDeviceFromDeviceID(addr)
-			if err != nil {
-				// handle err
-				log.Error(fmt.Errorf("Can't find device from deviceID, error: ", err))
-			}
-			device := reflect.ValueOf(fc.states.DeviceCollection[deviceIndex])
-			currentTemp := device.FieldByName("CurrentTemp").Interface().(float32)
-
-			val := currentTemp
-			props := fimpgo.Props{}
-			props["unit"] = "C"
-
-			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: addr}
-			msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, val, props, nil, newMsg.Payload)
-			fc.mqt.Publish(adr, msg)
+		fc.hubTokenUID = ""
+	}
+	handler, ok := fc.handlers.Lookup(newMsg.Payload.Service, newMsg.Payload.Type)
+	if !ok {
+		return
+	}
+	req := &Request{Msg: newMsg, Backend: mill.NewBackend(fc.configs.ApiBackend)}
+	if newMsg.Addr.ResourceType == fimpgo.ResourceTypeDevice {
+		// Device services are addressed by model.ServiceAddress, reports are sent on the current address scheme
+		serviceAddress, err := model.ParseServiceAddress(newMsg.Addr.ServiceAddress)
+		if err == nil && serviceAddress.Instance != "" && serviceAddress.Instance != fc.instanceID {
+			// Device of another account, the command would change a device with the same id on this account
+			err = fmt.Errorf("service address %q belongs to instance %s", newMsg.Addr.ServiceAddress, serviceAddress.Instance)
 		}
+		if err != nil {
+			// Answered like a failed command, so the sender learns the address is wrong
+			fc.reportErrors(func(req *Request) error {
+				return fmt.Errorf("%w: %v", errWrongFormat, err)
+			})(req)
+			return
+		}
+		req.DeviceID = serviceAddress.DeviceID
+		req.ServiceAddress = fc.states.ServiceAddress(fc.instanceID, req.DeviceID)
+	}
+	log.Debug(" ")
+	log.Debug("New fimp msg ", newMsg.Payload.Type)
+	fc.refresh(req.Backend)
+	fc.reportErrors(recoverPanics(handler))(req)
+}
 
-	case model.ServiceName:
-
-		log.Debug("New payload type ", newMsg.Payload.Type)
-		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
-		switch newMsg.Payload.Type {
-
-		case "cmd.auth.login":
-			newadr, msg, err := fc.configs.GetHubToken(newMsg)
-			if err != nil {
-				log.Error("Something went wrong when getting hub token")
-			} else {
-				fc.mqt.Publish(newadr, msg)
-			}
-
-			fc.configs.UID = newMsg.Payload.UID
-
-		case "cmd.auth.set_tokens":
-			if fc.configs.Auth.AuthorizationCode != "" {
-				fc.configs.Auth.AccessToken, fc.configs.Auth.RefreshToken, fc.configs.Auth.ExpireTime, fc.configs.Auth.RefreshExpireTime = config.NewClient(fc.configs.Auth.AuthorizationCode, fc.configs.Password, fc.configs.Username)
-				fc.configs.Username = ""
-				fc.configs.Password = ""
-				fc.configs.SaveToFile()
-				fc.states.SaveToFile()
-			} else {
-			}
-
-			if fc.configs.Auth.AccessToken != "" {
-				fc.appLifecycle.SetAuthState(model.AuthStateAuthenticated)
-				log.Debug("All tokens received and saved.")
-				loginval := map[string]interface{}{
-					"errors":  nil,
-					"success": true,
-				}
-				newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:rsp/rt:cloud/rn:remote-client/ad:smarthome-app")
-				if err != nil {
-					log.Debug("Could not make login response topic")
-				}
-				msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, loginval, nil, nil, newMsg.Payload)
-				msg.CorrelationID = fc.configs.UID
-				fc.mqt.Publish(newadr, msg)
-			} else {
-				fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
-				log.Debug("Login failed, please try again")
-				loginval := map[string]interface{}{
-					"errors":  "Wrong username or password",
-					"success": false,
-				}
-				newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:rsp/rt:cloud/rn:remote-client/ad:smarthome-app")
-				if err != nil {
-					log.Debug("Could not make login response topic")
-				}
-				msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, loginval, nil, nil, newMsg.Payload)
-				msg.CorrelationID = fc.configs.UID
-				fc.mqt.Publish(newadr, msg)
-			}
-
-			msg := fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.GetAllStates(), nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				// if response topic is not set , sending back to default application event topic
-				fc.mqt.Publish(adr, msg)
-			}
-
-			// Delete previously saved nodes, if there are any for some reason
-			fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-			fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection = client.UpdateLists(fc.configs.Auth.AccessToken, fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection)
-
-			msg = fimpgo.NewMessage("evt.network.get_all_nodes_report", model.ServiceName, fimpgo.VTypeObject, fc.states.DeviceCollection, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				// if response topic is not set , sending back to default application event topic
-				fc.mqt.Publish(adr, msg)
-			}
-
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				inclReport := ns.SendInclusionReport(i, fc.states.DeviceCollection)
-
-				msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, nil)
-				adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				fc.mqt.Publish(&adr, msg)
-			}
-			fc.configs.SaveToFile()
-			fc.states.SaveToFile()
-
-		case "cmd.auth.logout":
-			fc.configs.Auth.AccessToken = ""
-			fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
-			fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
-			fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				device := reflect.ValueOf(fc.states.DeviceCollection[i])
-				deviceID := strconv.FormatInt(device.FieldByName("DeviceID").Interface().(int64), 10)
-				val := map[string]interface{}{
-					"address": deviceID,
-				}
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				msg := fimpgo.NewMessage("evt.thing.exclusion_report", "mill", fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-				fc.mqt.Publish(adr, msg)
-			}
-
-			fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-			fc.configs.LoadDefaults()
-			fc.states.LoadDefaults()
-
-			val2 := map[string]interface{}{
-				"errors":  nil,
-				"success": true,
-			}
-			msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, val2, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				log.Error("Could not respond to wanted request")
-			}
-
-		case "cmd.network.get_all_nodes":
-			// This case saves all homes, rooms and devices, but only sends devices back to fimp.
-			fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-			fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection = client.UpdateLists(fc.configs.Auth.AccessToken, fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection)
-			report := []ListReportRecord{}
-			if len(fc.states.DeviceCollection) == 0 {
-				fmt.Errorf("There are no devices")
-				return
-			}
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				device := reflect.ValueOf(fc.states.DeviceCollection[i])
-				deviceID := strconv.FormatInt(device.FieldByName("DeviceID").Interface().(int64), 10)
-				name := device.FieldByName("DeviceName").Interface().(string)
-				rec := ListReportRecord{Address: deviceID, Alias: "Mill " + name, PowerSource: "ac", WakeupInterval: "-1"}
-				report = append(report, rec)
-			}
-
-			msg := fimpgo.NewMessage("evt.network.get_all_nodes_report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, newMsg.Payload)
-			msg.Source = "mill"
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				// if response topic is not set , sending back to default application event topic
-				fc.mqt.Publish(adr, msg)
-			}
-			fc.states.SaveToFile()
-
-		case "cmd.system.sync":
-
-			// only
-			fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-			fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection = client.UpdateLists(fc.configs.Auth.AccessToken, fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection)
-			log.Debug(fc.configs.Auth.AccessToken)
-
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				inclReport := ns.SendInclusionReport(i, fc.states.DeviceCollection)
-
-				msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, newMsg.Payload)
-				adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				fc.mqt.Publish(&adr, msg)
-			}
-
-			val2 := map[string]interface{}{
-				"errors":  nil,
-				"success": true,
-			}
-			msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, val2, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				log.Error("Could not respond to wanted request")
-			}
-
-		case "cmd.system.set_poll_time":
-			log.Debug("pollTime case")
-
-		case "cmd.app.get_manifest":
-			mode, err := newMsg.Payload.GetStringValue()
-			if err != nil {
-				log.Error("Incorrect request format ")
-				return
-			}
-			manifest := model.NewManifest()
-			err = manifest.LoadFromFile(filepath.Join(fc.configs.GetDefaultDir(), "app-manifest.json"))
-			if err != nil {
-				log.Error("Failed to load manifest file .Error :", err.Error())
-				return
-			}
-			if mode == "manifest_state" {
-				manifest.AppState = *fc.appLifecycle.GetAllStates()
-				fc.configs.ConnectionState = string(fc.appLifecycle.ConnectionState())
-				fc.configs.Errors = fc.appLifecycle.LastError()
-				manifest.ConfigState = fc.configs
-			}
-			if errConf := manifest.GetAppConfig("errors"); errConf != nil {
-				if fc.configs.Errors == "" {
-					errConf.Hidden = true
-				} else {
-					errConf.Hidden = false
-				}
-			}
-
-			connectButton := manifest.GetButton("connect")
-			disconnectButton := manifest.GetButton("disconnect")
-			if connectButton != nil && disconnectButton != nil {
-				if fc.appLifecycle.ConnectionState() == model.ConnStateConnected {
-					connectButton.Hidden = true
-					disconnectButton.Hidden = false
-				} else {
-					connectButton.Hidden = false
-					disconnectButton.Hidden = true
-				}
-			}
-			if syncButton := manifest.GetButton("sync"); syncButton != nil {
-				if fc.appLifecycle.ConnectionState() == model.ConnStateConnected {
-					syncButton.Hidden = false
-				} else {
-					syncButton.Hidden = false
-				}
-			}
-			pollTimeBlock := manifest.GetUIBlock("poll_time_min")
-			if pollTimeBlock != nil {
-				pollTimeBlock.Hidden = false
-			}
-			settingsBlock := manifest.GetUIBlock("settings")
-			if settingsBlock != nil {
-				settingsBlock.Hidden = false
-			}
-			msg := fimpgo.NewMessage("evt.app.manifest_report", model.ServiceName, fimpgo.VTypeObject, manifest, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				// if response topic is not set , sending back to default application event topic
-				fc.mqt.Publish(adr, msg)
-			}
-
-		case "cmd.app.get_state":
-			msg := fimpgo.NewMessage("evt.app.manifest_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.GetAllStates(), nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				// if response topic is not set , sending back to default application event topic
-				fc.mqt.Publish(adr, msg)
-			}
-
-		case "cmd.config.get_extended_report":
-
-			msg := fimpgo.NewMessage("evt.config.extended_report", model.ServiceName, fimpgo.VTypeObject, fc.configs, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				fc.mqt.Publish(adr, msg)
-			}
-
-		case "cmd.config.extended_set":
-			conf := model.Configs{}
-			err := newMsg.Payload.GetObjectValue(&conf)
-			if err != nil {
-				// TODO: This is an example . Add your logic here or remove
-				log.Error("Can't parse configuration object")
-				return
-			}
-			pollTimeMin := conf.PollTimeMin
-			_, err = strconv.Atoi(pollTimeMin)
-
-			if err != nil {
-				log.Error(fmt.Sprintf("%q is not a number or contains illegal symbols.", pollTimeMin))
-			} else {
-				fc.configs.PollTimeMin = pollTimeMin
-				fc.configs.SaveToFile()
-				log.Debug("App reconfigured.")
-				// TODO: This is an example . Add your logic here or remove
-			}
-
-			configReport := model.ConfigReport{
-				OpStatus: "ok",
-				AppState: *fc.appLifecycle.GetAllStates(),
-			}
-			msg := fimpgo.NewMessage("evt.app.config_report", model.ServiceName, fimpgo.VTypeObject, configReport, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				fc.mqt.Publish(adr, msg)
-			}
-
-		case "cmd.log.set_level":
-			// Configure log level
-			level, err := newMsg.Payload.GetStringValue()
-			if err != nil {
-				return
-			}
-			logLevel, err := log.ParseLevel(level)
-			if err == nil {
-				log.SetLevel(logLevel)
-				fc.configs.LogLevel = level
-				fc.configs.SaveToFile()
-				fc.states.SaveToFile()
-			}
-			log.Info("Log level updated to = ", logLevel)
-
-		case "cmd.system.reconnect":
-			// This is optional operation.
-			fc.appLifecycle.PublishEvent(model.EventConfigured, "from-fimp-router", nil)
-
-			val := model.ButtonActionResponse{
-				Operation:       "cmd.system.reconnect",
-				OperationStatus: "ok",
-				Next:            "config",
-				ErrorCode:       "",
-				ErrorText:       "",
-			}
-			msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				fc.mqt.Publish(adr, msg)
-			}
-
-		case "cmd.app.factory_reset":
-			val := model.ButtonActionResponse{
-				Operation:       "cmd.app.factory_reset",
-				OperationStatus: "ok",
-				Next:            "config",
-				ErrorCode:       "",
-				ErrorText:       "",
-			}
-			fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
+// refresh updates lifecycle, tokens and home, room and device lists before a message is handled
+func (fc *FromFimpRouter) refresh(backend mill.Backend) {
+	// Connection state follows calls to Mill, see AccountManager.RecordMillResult
+	if fc.configs.IsConfigured() {
+		fc.appLifecycle.SetConfigState(model.ConfigStateConfigured)
+		if fc.appLifecycle.AppState() == model.AppStateNotConfigured {
+			fc.appLifecycle.SetAppState(model.AppStateRunning, nil)
+		}
+	} else {
+		fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
+		fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
+		if fc.appLifecycle.AppState() == model.AppStateRunning {
 			fc.appLifecycle.SetAppState(model.AppStateNotConfigured, nil)
-			fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
-			msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				fc.mqt.Publish(adr, msg)
-			}
-
-		case "cmd.thing.get_inclusion_report":
-			deviceID, err := newMsg.Payload.GetStringValue()
-			if err != nil {
-				// handle err
-				log.Error(fmt.Errorf("Can't get strValue, error: ", err))
-			}
-			nodeID, err := fc.states.FindDeviceFromDeviceID(deviceID)
-			if err != nil { // normal error handling did not work for some reason, find out why
-				// handle error
-				log.Error("error") // this never executes
-			}
-			if nodeID != 9999 { // using this method instead
-				inclReport := ns.SendInclusionReport(nodeID, fc.states.DeviceCollection)
+		}
+	}
 
-				msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, nil)
-				adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				fc.mqt.Publish(&adr, msg)
-			}
+	fc.refreshTokens(backend)
+	fc.updateLists(backend)
+}
 
-		case "cmd.thing.inclusion":
-			//flag , _ := newMsg.Payload.GetBoolValue()
-			// TODO: This is an example . Add your logic here or remove
-		case "cmd.thing.delete":
-			// remove device from network
-			val, err := newMsg.Payload.GetStrMapValue()
-			if err != nil {
-				log.Error("Wrong msg format")
-				return
-			}
-			deviceID := val["address"]
-			deviceExists, err := fc.states.FindDeviceFromDeviceID(deviceID)
-			if deviceExists != 9999 {
-				val := map[string]interface{}{
-					"address": deviceID,
-				}
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				msg := fimpgo.NewMessage("evt.thing.exclusion_report", "mill", fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-				fc.mqt.Publish(adr, msg)
-				log.Info("Device with deviceID: ", deviceID, " has been removed from network.")
-			}
+// refreshTokens gets new tokens if expires_in is exceeded. expireTime lasts for two hours, refreshExpireTime lasts
+// for 30 days. Tokens refreshed by the poller while waiting for Mill are kept.
+func (fc *FromFimpRouter) refreshTokens(backend mill.Backend) {
+	if fc.configs.Auth.ExpireTime == 0 {
+		return
+	}
+	millis := time.Now().UnixNano() / 1000000
+	if millis > fc.configs.Auth.RefreshExpireTime {
+		log.Error("30 day refreshExpireTime has expired. Restard adapter or send cmd.auth.login")
+		fc.appLifecycle.SetError(model.ErrorSourceAuth, model.ErrCodeNotLoggedIn, "Mill login expired, please log in again")
+		return
+	}
+	if millis <= fc.configs.Auth.ExpireTime {
+		return
+	}
+	oldRefreshToken := fc.configs.Auth.RefreshToken
+	var accessToken, refreshToken string
+	var expireTime, refreshExpireTime int64
+	var err error
+	fc.unlocked(func() {
+		accessToken, refreshToken, expireTime, refreshExpireTime, err = backend.RefreshToken(fc.ctx, oldRefreshToken)
+	})
+	if fc.configs.Auth.RefreshToken != oldRefreshToken {
+		log.Debug("<router> Tokens changed while refreshing, keeping the new tokens")
+		return
+	}
+	if err == nil {
+		fc.configs.Auth.AccessToken = accessToken
+		fc.configs.Auth.RefreshToken = refreshToken
+		fc.configs.Auth.ExpireTime = expireTime
+		fc.configs.Auth.RefreshExpireTime = refreshExpireTime
+		fc.appLifecycle.ClearError(model.ErrorSourceAuth)
+	} else {
+		fc.configs.Auth.ExpireTime = 1
+		fc.appLifecycle.SetError(model.ErrorSourceAuth, model.ErrCodeNotLoggedIn, "Can't refresh Mill login: "+err.Error())
+	}
+	fc.states.SaveToFile()
+}
 
-		case "cmd.app.uninstall":
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				device := reflect.ValueOf(fc.states.DeviceCollection[i])
-				deviceID := strconv.FormatInt(device.FieldByName("DeviceID").Interface().(int64), 10)
-				val := map[string]interface{}{
-					"address": deviceID,
-				}
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				msg := fimpgo.NewMessage("evt.thing.exclusion_report", "mill", fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-				fc.mqt.Publish(adr, msg)
-			}
+// updateLists fetches home, room and device lists. Lists are reused for a burst of messages, like commands from
+// a slider, until they are listsMaxAge old or the token changes. Last good lists are kept if fetching fails.
+func (fc *FromFimpRouter) updateLists(backend mill.Backend) error {
+	accessToken := fc.configs.Auth.AccessToken
+	if fc.listsToken == accessToken && time.Since(fc.listsUpdatedAt) < listsMaxAge {
+		return nil
+	}
+	var hc, rc, dc, idc []interface{}
+	var err error
+	fc.unlocked(func() {
+		hc, rc, dc, idc, err = backend.UpdateLists(fc.ctx, accessToken, nil, nil, nil, nil)
+		if accessToken != "" {
+			fc.accounts.RecordMillResult(fc.instanceID, err)
 		}
-
-	case "auth-api":
-		fc.configs.Auth.AuthorizationCode, fc.configs.HubToken = config.GetAuthCode(newMsg)
-
-		msg := fimpgo.NewMessage("cmd.auth.set_tokens", model.ServiceName, fimpgo.VTypeString, "", nil, nil, newMsg.Payload)
-		newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:cmd/rt:ad/rn:mill/ad:1")
-		if err != nil {
-			log.Debug(err)
+	})
+	if fc.configs.Auth.AccessToken != accessToken {
+		// Lists of another login, or of an account that was logged out, are not used
+		log.Debug("<router> Token changed while updating lists, lists are not used")
+		return errTokenChanged
+	}
+	if err != nil {
+		// Last good lists are kept, see States.ListsFailed
+		log.Error("<router> Can't update lists. Error: ", err)
+		if accessToken != "" {
+			fc.states.ListsFailed(time.Now())
 		}
-		fc.mqt.Publish(newadr, msg)
+	} else {
+		fc.states.SetLists(hc, rc, dc, idc, time.Now())
+		fc.listsUpdatedAt, fc.listsToken = time.Now(), accessToken
 	}
+	fc.states.FilterHomes(fc.configs.SelectedHomes)
+	fc.states.SaveToFile()
+	return err
+}
+
+// unlocked runs call with the lock released. Handlers run with the lock held, calls to Mill and heaters are made
+// through unlocked, so a slow call doesn't hold up the poller of the account. Configs and states used by call
+// are read before, results are applied after, and may have been changed by the poller in between.
+func (fc *FromFimpRouter) unlocked(call func()) {
+	fc.lock.Unlock()
+	defer fc.lock.Lock()
+	call()
 }
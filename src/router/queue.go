@@ -0,0 +1,129 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// commandDebounce is how long a command waits for newer commands to the same device and service
+	commandDebounce = time.Second
+	// millCallInterval is the minimum time between calls to Mill on behalf of commands, on all devices of all accounts
+	millCallInterval = time.Second
+)
+
+// millLimiter is shared by the routers of all accounts, so adding accounts doesn't raise the rate of calls to Mill
+var millLimiter = newRateLimiter(millCallInterval)
+
+// WaitForMill blocks until the caller may call Mill. Pollers wait on the limiter of commands, so device reads
+// between fetches don't raise the rate of calls to Mill either.
+func WaitForMill() {
+	millLimiter.wait()
+}
+
+// rateLimiter spaces calls to Mill evenly. Callers wait in turn, so calls are also serialised.
+type rateLimiter struct {
+	mux      sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	return &rateLimiter{interval: interval}
+}
+
+// wait blocks until the caller may call Mill
+func (rl *rateLimiter) wait() {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+	now := time.Now()
+	if rl.next.After(now) {
+		time.Sleep(rl.next.Sub(now))
+		now = rl.next
+	}
+	rl.next = now.Add(rl.interval)
+}
+
+// commandQueue coalesces commands to the same device and service, so a burst of commands, like dragging a setpoint
+// slider, only sends the latest value to Mill. Queued commands are run one at a time.
+type commandQueue struct {
+	mux     sync.Mutex
+	latest  map[string]func()
+	readyCh chan string
+	stopCh  chan struct{}
+	limiter *rateLimiter
+}
+
+func newCommandQueue(limiter *rateLimiter, stopCh chan struct{}) *commandQueue {
+	return &commandQueue{latest: make(map[string]func()), readyCh: make(chan string, 100), stopCh: stopCh, limiter: limiter}
+}
+
+// submit queues run under key, replacing a queued command with the same key
+func (q *commandQueue) submit(key string, run func()) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if _, queued := q.latest[key]; queued {
+		log.Debug("<router> Coalescing command ", key)
+		q.latest[key] = run
+		return
+	}
+	q.latest[key] = run
+	time.AfterFunc(commandDebounce, func() {
+		select {
+		case q.readyCh <- key:
+		case <-q.stopCh:
+		}
+	})
+}
+
+// run sends queued commands to Mill until the router is stopped. Commands still waiting are sent before run returns.
+func (q *commandQueue) run() {
+	for {
+		select {
+		case key := <-q.readyCh:
+			q.mux.Lock()
+			run, ok := q.latest[key]
+			delete(q.latest, key)
+			q.mux.Unlock()
+			if ok {
+				q.limiter.wait()
+				run()
+			}
+		case <-q.stopCh:
+			q.drain()
+			return
+		}
+	}
+}
+
+// drain sends all queued commands without waiting for debounce
+func (q *commandQueue) drain() {
+	q.mux.Lock()
+	queued := q.latest
+	q.latest = make(map[string]func())
+	q.mux.Unlock()
+	for key, run := range queued {
+		log.Debug("<router> Sending queued command ", key, " before stopping")
+		q.limiter.wait()
+		run()
+	}
+}
+
+// queued runs the handler from the command queue. Errors are reported when the command is run, the request
+// itself is answered when Mill has been called.
+func (fc *FromFimpRouter) queued(next HandlerFunc) HandlerFunc {
+	return func(req *Request) error {
+		key := req.DeviceID + "/" + req.Msg.Payload.Service + "/" + req.Msg.Payload.Type
+		fc.commands.submit(key, func() {
+			fc.lock.Lock()
+			fc.recordControlResult(req, fc.reportErrors(recoverPanics(next))(req))
+			fc.lock.Unlock()
+			// Device is polled more often for a while, so reports follow the change quickly
+			fc.states.MarkCommand(req.DeviceID, time.Now())
+			fc.accounts.Reschedule(fc.instanceID)
+		})
+		return nil
+	}
+}
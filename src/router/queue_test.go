@@ -0,0 +1,163 @@
+package router
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thingsplex/mill/model"
+)
+
+// runs records commands run by a queue
+type runs struct {
+	mux   sync.Mutex
+	names []string
+	at    []time.Time
+	ch    chan string
+}
+
+func newRuns() *runs {
+	return &runs{ch: make(chan string, 10)}
+}
+
+// command returns a command that records name when it is run
+func (r *runs) command(name string) func() {
+	return func() {
+		r.mux.Lock()
+		r.names = append(r.names, name)
+		r.at = append(r.at, time.Now())
+		r.mux.Unlock()
+		r.ch <- name
+	}
+}
+
+// wait waits for n commands to run
+func (r *runs) wait(t *testing.T, n int) {
+	t.Helper()
+	timeout := time.After(5 * commandDebounce)
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.ch:
+		case <-timeout:
+			t.Fatalf("%d of %d commands were run", i, n)
+		}
+	}
+}
+
+func TestQueueCoalescesCommands(t *testing.T) {
+	stopCh := make(chan struct{})
+	q := newCommandQueue(newRateLimiter(0), stopCh)
+	done := make(chan struct{})
+	go func() {
+		q.run()
+		close(done)
+	}()
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+
+	r := newRuns()
+	// Setpoint slider is dragged on one heater while another heater is turned off
+	for _, temp := range []string{"20", "20.5", "21"} {
+		q.submit("d1/thermostat/cmd.setpoint.set", r.command("d1 "+temp))
+	}
+	q.submit("d2/thermostat/cmd.mode.set", r.command("d2 off"))
+	r.wait(t, 2)
+	// Nothing else is run after the debounce of a later command would have passed
+	time.Sleep(commandDebounce / 2)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	sort.Strings(r.names)
+	if len(r.names) != 2 || r.names[0] != "d1 21" || r.names[1] != "d2 off" {
+		t.Errorf("queue ran %v, expected the latest setpoint and the mode", r.names)
+	}
+}
+
+func TestQueueDebouncesCommands(t *testing.T) {
+	stopCh := make(chan struct{})
+	q := newCommandQueue(newRateLimiter(0), stopCh)
+	done := make(chan struct{})
+	go func() {
+		q.run()
+		close(done)
+	}()
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+
+	r := newRuns()
+	submitted := time.Now()
+	q.submit("d1/thermostat/cmd.setpoint.set", r.command("d1 21"))
+	r.wait(t, 1)
+	if waited := r.at[0].Sub(submitted); waited < commandDebounce {
+		t.Errorf("command was run after %v, expected to wait %v for newer commands", waited, commandDebounce)
+	}
+}
+
+func TestQueueDrainsOnStop(t *testing.T) {
+	stopCh := make(chan struct{})
+	q := newCommandQueue(newRateLimiter(0), stopCh)
+	done := make(chan struct{})
+	go func() {
+		q.run()
+		close(done)
+	}()
+
+	r := newRuns()
+	q.submit("d1/thermostat/cmd.setpoint.set", r.command("d1 21"))
+	q.submit("d2/thermostat/cmd.mode.set", r.command("d2 off"))
+	stopped := time.Now()
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * commandDebounce):
+		t.Fatal("queue didn't stop")
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.names) != 2 {
+		t.Fatalf("queue ran %v before stopping, expected both queued commands", r.names)
+	}
+	if waited := r.at[1].Sub(stopped); waited >= commandDebounce {
+		t.Errorf("queued commands were run %v after stop, expected without debounce", waited)
+	}
+}
+
+func TestQueuesOfAllAccountsShareLimiter(t *testing.T) {
+	// Routers of two accounts use the same limiter
+	mainRouter := newTestRouter(&model.Configs{})
+	otherRouter := newTestRouter(&model.Configs{InstanceAddress: "2"})
+	if mainRouter.commands.limiter != millLimiter || otherRouter.commands.limiter != millLimiter {
+		t.Fatal("routers don't use the shared limiter")
+	}
+
+	// Commands submitted to both queues at once are spaced by the limiter
+	interval := 200 * time.Millisecond
+	limiter := newRateLimiter(interval)
+	stopCh := make(chan struct{})
+	r := newRuns()
+	var running sync.WaitGroup
+	for _, device := range []string{"d1", "d2"} {
+		q := newCommandQueue(limiter, stopCh)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			q.run()
+		}()
+		q.submit(device+"/thermostat/cmd.setpoint.set", r.command(device))
+	}
+	defer func() {
+		close(stopCh)
+		running.Wait()
+	}()
+	r.wait(t, 2)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	gap := r.at[1].Sub(r.at[0])
+	if gap < interval-10*time.Millisecond {
+		t.Errorf("commands of two accounts were run %v apart, expected at least %v", gap, interval)
+	}
+}
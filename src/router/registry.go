@@ -0,0 +1,183 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/model"
+)
+
+var (
+	errNotLoggedIn   = errors.New("not logged in to Mill")
+	errWrongFormat   = errors.New("wrong msg format")
+	errControlFailed = errors.New("Mill did not accept the command")
+	errInternal      = errors.New("internal error")
+	errTokenChanged  = errors.New("Mill login changed during the call")
+)
+
+// errorCode maps handler errors to error codes in evt.error.report
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errNotLoggedIn), errors.Is(err, mill.ErrUnauthorized):
+		return model.ErrCodeNotLoggedIn
+	case errors.Is(err, model.ErrDeviceNotFound):
+		return model.ErrCodeDeviceNotFound
+	case errors.Is(err, errWrongFormat):
+		return model.ErrCodeWrongFormat
+	case errors.Is(err, errControlFailed):
+		return model.ErrCodeControlFailed
+	case errors.Is(err, errInternal):
+		return model.ErrCodeInternal
+	}
+	return model.ErrCodeFailed
+}
+
+// Request is a FIMP message being handled
+type Request struct {
+	Msg     *fimpgo.Message
+	Backend mill.Backend
+	// DeviceID is Mill deviceID decoded from the service address, empty for adapter messages
+	DeviceID string
+	// ServiceAddress is the current service address of the device, reports are published on it
+	ServiceAddress string
+	// Device is the addressed device from DeviceCollection, only set by the withDevice middleware
+	Device reflect.Value
+}
+
+// HandlerFunc handles one message type. Returned errors are reported by the dispatcher.
+type HandlerFunc func(req *Request) error
+
+// Middleware wraps a handler with shared behaviour, like auth checks or device lookup
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type handlerKey struct {
+	service string
+	msgType string
+}
+
+// Registry maps service and interface type to handlers
+type Registry struct {
+	handlers map[handlerKey]HandlerFunc
+}
+
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[handlerKey]HandlerFunc)}
+}
+
+// Handle registers handler for service and interface type, "*" matches any type. Middleware runs in the given order before the handler.
+func (r *Registry) Handle(service string, msgType string, handler HandlerFunc, middleware ...Middleware) {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	r.handlers[handlerKey{service: service, msgType: msgType}] = handler
+}
+
+// Lookup returns handler registered for service and interface type, or for all interface types of the service ("*")
+func (r *Registry) Lookup(service string, msgType string) (HandlerFunc, bool) {
+	handler, ok := r.handlers[handlerKey{service: service, msgType: msgType}]
+	if !ok {
+		handler, ok = r.handlers[handlerKey{service: service, msgType: "*"}]
+	}
+	return handler, ok
+}
+
+// requireLogin stops requests that need a Mill access token when the user is not logged in
+func (fc *FromFimpRouter) requireLogin(next HandlerFunc) HandlerFunc {
+	return func(req *Request) error {
+		if !fc.configs.IsConfigured() {
+			return errNotLoggedIn
+		}
+		return next(req)
+	}
+}
+
+// withDevice looks up the addressed device in DeviceCollection
+func (fc *FromFimpRouter) withDevice(next HandlerFunc) HandlerFunc {
+	return func(req *Request) error {
+		device, err := fc.findDevice(req.DeviceID)
+		if err != nil {
+			return err
+		}
+		req.Device = device
+		return next(req)
+	}
+}
+
+// reportErrors logs errors returned by handlers and answers failed commands with evt.error.report
+func (fc *FromFimpRouter) reportErrors(next HandlerFunc) HandlerFunc {
+	return func(req *Request) error {
+		err := next(req)
+		if err == nil {
+			return nil
+		}
+		log.Error("<router> ", req.Msg.Payload.Service, " ", req.Msg.Payload.Type, " failed. Error: ", err)
+		if !strings.HasPrefix(req.Msg.Payload.Type, "cmd.") {
+			return err
+		}
+		fc.sendErrorReport(req, err)
+		return err
+	}
+}
+
+// sendErrorReport answers req with evt.error.report
+func (fc *FromFimpRouter) sendErrorReport(req *Request, err error) {
+	report := model.ErrorReport{
+		ErrorCode:   errorCode(err),
+		ErrorText:   err.Error(),
+		RequestType: req.Msg.Payload.Type,
+		RequestUID:  req.Msg.Payload.UID,
+	}
+	msg := fimpgo.NewMessage("evt.error.report", req.Msg.Payload.Service, fimpgo.VTypeObject, report, nil, nil, req.Msg.Payload)
+	if fc.mqt.RespondToRequest(req.Msg.Payload, msg) != nil {
+		if replyErr := fc.reply(req, msg); replyErr != nil {
+			log.Error("<router> Can't send error report. Error: ", replyErr)
+		}
+	}
+}
+
+// recoverPanics turns a panic in a handler into an error, so bad input can't crash the adapter
+func recoverPanics(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%w: %v", errInternal, r)
+			}
+		}()
+		return next(req)
+	}
+}
+
+func (fc *FromFimpRouter) findDevice(deviceID string) (reflect.Value, error) {
+	index, err := fc.states.FindDeviceFromDeviceID(deviceID)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return reflect.ValueOf(fc.states.DeviceCollection[index]), nil
+}
+
+// reply sends msg in response to req. Device reports are published on the service topic, so all consumers see
+// the new state. Adapter messages are sent to the response topic of the request, or to the adapter event topic.
+func (fc *FromFimpRouter) reply(req *Request, msg *fimpgo.FimpMessage) error {
+	if req.DeviceID != "" {
+		return fc.mqt.Publish(fc.deviceEventAddress(msg.Service, req.ServiceAddress), msg)
+	}
+	if err := fc.mqt.RespondToRequest(req.Msg.Payload, msg); err != nil {
+		// if response topic is not set , sending back to default application event topic
+		return fc.mqt.Publish(fc.adapterEventAddress(), msg)
+	}
+	return nil
+}
+
+func (fc *FromFimpRouter) adapterEventAddress() *fimpgo.Address {
+	return &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+}
+
+func (fc *FromFimpRouter) deviceEventAddress(service string, serviceAddress string) *fimpgo.Address {
+	return &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID, ServiceName: service, ServiceAddress: serviceAddress}
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"errors"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+
+	mill "github.com/thingsplex/mill/millapi"
+	"github.com/thingsplex/mill/model"
+)
+
+// syncDevices fetches devices from Mill, includes all devices not deleted by the user and excludes devices
+// removed from the Mill account. Lists are left untouched if Mill can't be reached.
+func (fc *FromFimpRouter) syncDevices(backend mill.Backend, reqMsg *fimpgo.Message) model.SyncResult {
+	ns := fc.networkService()
+	result := model.SyncResult{SyncedAt: time.Now().Format(time.RFC3339)}
+
+	accessToken := fc.configs.Auth.AccessToken
+	var hc, rc, dc, idc []interface{}
+	var err error
+	fc.unlocked(func() {
+		hc, rc, dc, idc, err = backend.UpdateLists(fc.ctx, accessToken, nil, nil, nil, nil)
+		if accessToken != "" {
+			fc.accounts.RecordMillResult(fc.instanceID, err)
+		}
+	})
+	if err == nil && fc.configs.Auth.AccessToken != accessToken {
+		err = errTokenChanged
+	}
+	if err != nil {
+		log.Error("<router> Sync failed. Error: ", err)
+		switch {
+		case errors.Is(err, mill.ErrUnauthorized):
+			result.Error = "Login expired, please log in again"
+		case errors.Is(err, errTokenChanged):
+			result.Error = "Login changed during sync, please sync again"
+		default:
+			result.Error = "Can't reach Mill: " + err.Error()
+		}
+		return result
+	}
+	fc.states.SetLists(hc, rc, dc, idc, time.Now())
+	fc.states.FilterHomes(fc.configs.SelectedHomes)
+
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+	changes := fc.states.ReconcileTopology(time.Now(), fc.configs.RemovalGrace())
+	for _, deviceID := range changes.Removed {
+		if fc.states.IsExcluded(deviceID) {
+			continue
+		}
+		val := map[string]interface{}{
+			"address": deviceID,
+		}
+		msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, reqMsg.Payload)
+		if err := fc.mqt.Publish(adr, msg); err != nil {
+			result.Failed = append(result.Failed, deviceID)
+			continue
+		}
+		result.Removed = append(result.Removed, deviceID)
+	}
+
+	added := make(map[int]bool)
+	for _, i := range changes.Added {
+		added[i] = true
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < len(fc.states.DeviceCollection); i++ {
+		deviceID := model.DeviceID(fc.states.DeviceCollection[i])
+		// Devices deleted by the user stay deleted, they can be included again with cmd.thing.reinclude
+		if seen[deviceID] || fc.states.IsExcluded(deviceID) {
+			continue
+		}
+		seen[deviceID] = true
+		inclReport := ns.SendInclusionReport(i, fc.states.DeviceCollection)
+
+		msg := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, reqMsg.Payload)
+		switch {
+		case fc.mqt.Publish(adr, msg) != nil:
+			result.Failed = append(result.Failed, deviceID)
+		case added[i]:
+			result.Added = append(result.Added, deviceID)
+		default:
+			result.Unchanged = append(result.Unchanged, deviceID)
+		}
+	}
+	// All devices were announced with the current service address scheme
+	fc.states.AddressScheme = model.AddressScheme
+	return result
+}